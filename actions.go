@@ -0,0 +1,337 @@
+package bps
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// A single action read from the action stream, with its relative offset
+// resolved against the running source or target offset
+type resolved_action struct {
+	action_num uint64
+	length     uint64
+	// Where in the target the action starts writing
+	output_offset uint64
+	// Where the action reads from: the source for SourceRead and SourceCopy,
+	// the target for TargetCopy
+	read_offset uint64
+	// The offset as stored in the patch, relative to the end of the previous
+	// copy of the same kind
+	relative_offset int64
+	// The literal bytes stored in the patch for a TargetRead
+	payload []byte
+}
+
+// Where the walker reads raw action bytes from: the Actions of a parsed patch,
+// or a patch file being streamed from disk
+type action_stream interface {
+	// Number of action bytes not yet read
+	remaining() uint64
+	read_num() (uint64, error)
+	// Read the next length bytes, which the caller has checked remain.  The
+	// returned slice is only valid until the next read.
+	read_payload(length uint64) ([]byte, error)
+}
+
+// An action_stream over a slice held in memory, which hands out payloads
+// without copying them
+type slice_actions struct {
+	data []byte
+}
+
+func (actions *slice_actions) remaining() uint64 {
+	return uint64(len(actions.data))
+}
+
+func (actions *slice_actions) read_num() (data uint64, err error) {
+	data, actions.data, err = bps_read_num(actions.data)
+	return
+}
+
+func (actions *slice_actions) read_payload(length uint64) ([]byte, error) {
+	payload := actions.data[:length]
+	actions.data = actions.data[length:]
+	return payload, nil
+}
+
+// Walk the action stream, resolving relative offsets and checking every action
+// against the declared source and target sizes, and call fn for each action in
+// order.  Returns the number of target bytes the actions produce.
+func (patch *BPSPatch) walk_actions(fn func(action *resolved_action) error) (output_offset uint64, err error) {
+	return patch.walk_actions_within(&slice_actions{data: patch.Actions}, patch.TargetSize, fn)
+}
+
+// Walk the actions read from actions as walk_actions does, but bound the
+// output by target_limit rather than the declared TargetSize
+func (patch *BPSPatch) walk_actions_within(actions action_stream, target_limit uint64, fn func(action *resolved_action) error) (output_offset uint64, err error) {
+	var state walk_state
+	err = patch.walk_actions_from(actions, &state, target_limit, fn)
+	return state.output_offset, err
+}
+
+// The running offsets of an action walk, which are all it needs to carry on
+// from the next action
+type walk_state struct {
+	output_offset uint64
+	// The offsets the next SourceCopy and TargetCopy are relative to
+	source_offset uint64
+	target_offset uint64
+}
+
+// Walk the actions read from actions as walk_actions_within does, starting
+// from state rather than the start of the patch and advancing it as each
+// action is walked.  When fn is called the copy offsets are already past the
+// action, but output_offset is only advanced once fn returns.
+func (patch *BPSPatch) walk_actions_from(actions action_stream, state *walk_state, target_limit uint64, fn func(action *resolved_action) error) (err error) {
+	var action resolved_action
+
+	for actions.remaining() > 0 {
+		output_offset := state.output_offset
+
+		// Every action consumes at least its header byte, so the loop always
+		// terminates.  Guard that here rather than trusting each case to.
+		remaining_before := actions.remaining()
+
+		var header uint64
+		header, err = actions.read_num()
+		if err != nil {
+			err = fmt.Errorf("Read Action: %w", err)
+			return
+		}
+		// First two bits of the header are the action num
+		action.action_num = header & 0b11
+		// Remaining bits are the length minus one
+		action.length = (header >> 2) + 1
+		action.output_offset = output_offset
+		action.relative_offset = 0
+		action.payload = nil
+
+		err = check_bounds(action_names[action.action_num], "target", output_offset, action.length, target_limit)
+		if err != nil {
+			return
+		}
+
+		switch action.action_num {
+		case SourceRead:
+			// Read from the source using the output offset as the index for both source and target
+			action.read_offset = output_offset
+			err = check_bounds("SourceRead", "source", action.read_offset, action.length, patch.SourceSize)
+		case TargetRead:
+			// The data to write is stored in the patch itself
+			if action.length > actions.remaining() {
+				err = fmt.Errorf("TargetRead out of bounds: len %d but only %d patch bytes remain", action.length, actions.remaining())
+				return
+			}
+			action.payload, err = actions.read_payload(action.length)
+		case SourceCopy:
+			// Read from somewhere else in the source file.  Increment or decrement the source offset before copying
+			var data uint64
+			data, err = actions.read_num()
+			if err != nil {
+				err = fmt.Errorf("Source copy data read: %w", err)
+				return
+			}
+			action.read_offset, err = apply_relative_offset(state.source_offset, data)
+			if err != nil {
+				err = fmt.Errorf("SourceCopy offset underflow at output %d", output_offset)
+				return
+			}
+			action.relative_offset = DecodeSignedOffset(data)
+			err = check_bounds("SourceCopy", "source", action.read_offset, action.length, patch.SourceSize)
+			state.source_offset = action.read_offset + action.length
+		case TargetCopy:
+			// Read from somewhere earlier in the target file.  Increment or decrement the target offset before copying
+			var data uint64
+			data, err = actions.read_num()
+			if err != nil {
+				err = fmt.Errorf("Target Copy Read %w", err)
+				return
+			}
+			action.read_offset, err = apply_relative_offset(state.target_offset, data)
+			if err != nil {
+				err = fmt.Errorf("TargetCopy offset underflow at output %d", output_offset)
+				return
+			}
+			action.relative_offset = DecodeSignedOffset(data)
+			// Each byte copied must already have been written, which holds
+			// for the whole run as long as the copy starts behind the output
+			if action.read_offset >= output_offset {
+				err = fmt.Errorf("TargetCopy out of bounds: offset %d len %d but only %d bytes written", action.read_offset, action.length, output_offset)
+			}
+			state.target_offset = action.read_offset + action.length
+		}
+		if err != nil {
+			return
+		}
+
+		if actions.remaining() >= remaining_before {
+			err = fmt.Errorf("%s at output %d consumed no patch bytes", action_names[action.action_num], output_offset)
+			return
+		}
+
+		err = fn(&action)
+		if err != nil {
+			return
+		}
+
+		state.output_offset += action.length
+	}
+
+	return
+}
+
+// A decoded patch action
+type Action struct {
+	// One of SourceRead, TargetRead, SourceCopy or TargetCopy
+	Kind int
+	// Number of target bytes the action writes
+	Length uint64
+	// For SourceCopy and TargetCopy, how far the action moves the source or
+	// target offset before copying.  Each copy leaves its offset just past the
+	// last byte it copied.
+	RelativeOffset int64
+	// For TargetRead, the literal target bytes stored in the patch.  This
+	// shares memory with Actions.
+	Data []byte
+}
+
+// Decode the raw action stream into a slice of Actions
+func (patch *BPSPatch) DecodeActions() ([]Action, error) {
+	var actions []Action
+
+	_, err := patch.walk_actions(func(action *resolved_action) error {
+		actions = append(actions, Action{
+			Kind:           int(action.action_num),
+			Length:         action.length,
+			RelativeOffset: action.relative_offset,
+			Data:           action.payload,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+// Encode actions into a raw action stream, suitable for the Actions field of a
+// BPSPatch.  This is the inverse of DecodeActions.
+func EncodeActions(actions []Action) ([]byte, error) {
+	var encoded bytes.Buffer
+	encoded.Grow(encoded_actions_len(actions))
+
+	for i, action := range actions {
+		if action.Kind < SourceRead || action.Kind > TargetCopy {
+			return nil, fmt.Errorf("Action %d has unknown kind %d", i, action.Kind)
+		}
+		if action.Length == 0 {
+			return nil, fmt.Errorf("Action %d has zero length", i)
+		}
+		if action.Length > max_action_length {
+			return nil, fmt.Errorf("Action %d length %d is longer than an action header can hold", i, action.Length)
+		}
+
+		err := write_action(&encoded, uint64(action.Kind), action.Length)
+		if err != nil {
+			return nil, err
+		}
+
+		switch action.Kind {
+		case TargetRead:
+			if uint64(len(action.Data)) != action.Length {
+				return nil, fmt.Errorf("Action %d is a TargetRead of %d bytes with %d bytes of data", i, action.Length, len(action.Data))
+			}
+			encoded.Write(action.Data)
+		case SourceCopy, TargetCopy:
+			err = write_relative_offset(&encoded, action.RelativeOffset)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encoded.Bytes(), nil
+}
+
+// Calculate how many bytes EncodeActions will produce for actions, so the
+// output can be allocated once.  Invalid actions, which EncodeActions rejects,
+// are counted as best they can be.
+func encoded_actions_len(actions []Action) int {
+	size := 0
+	for _, action := range actions {
+		size += VarintLen(((action.Length - 1) << 2) | uint64(action.Kind&0b11))
+		switch action.Kind {
+		case TargetRead:
+			size += len(action.Data)
+		case SourceCopy, TargetCopy:
+			if action.RelativeOffset != math.MinInt64 {
+				size += VarintLen(EncodeSignedOffset(action.RelativeOffset))
+			}
+		}
+	}
+	return size
+}
+
+// Check the patch is internally consistent, without needing the source file.
+// Every action must decode cleanly and stay within the declared source and
+// target sizes, and the actions must produce exactly TargetSize bytes.
+func (patch *BPSPatch) Validate() error {
+	output_size, err := patch.walk_actions(func(*resolved_action) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	if output_size != patch.TargetSize {
+		return fmt.Errorf("Patch produced %d bytes, expected %d", output_size, patch.TargetSize)
+	}
+
+	return nil
+}
+
+// Encode a relative copy offset as stored in SourceCopy and TargetCopy
+// actions: the absolute value shifted up one bit, with the lowest bit flagging
+// a negative offset.  Every int64 except math.MinInt64 can be encoded, as its
+// absolute value needs all 64 bits; passing it panics.
+func EncodeSignedOffset(delta int64) uint64 {
+	if delta == math.MinInt64 {
+		panic("bps: EncodeSignedOffset of math.MinInt64")
+	}
+	if delta < 0 {
+		return uint64(-delta)<<1 | 1
+	}
+	return uint64(delta) << 1
+}
+
+// Decode a relative copy offset encoded by EncodeSignedOffset.  Every uint64
+// decodes to a valid int64, with a negative zero decoding to zero.
+func DecodeSignedOffset(encoded uint64) int64 {
+	delta := int64(encoded >> 1)
+	if encoded&1 == 1 {
+		return -delta
+	}
+	return delta
+}
+
+// Adjust offset by an encoded relative offset.  Fails if a negative offset
+// would move before the start of the file.
+func apply_relative_offset(offset uint64, data uint64) (uint64, error) {
+	delta := DecodeSignedOffset(data)
+	if delta < 0 {
+		if uint64(-delta) > offset {
+			return 0, fmt.Errorf("Relative offset %d underflows offset %d", delta, offset)
+		}
+		return offset - uint64(-delta), nil
+	}
+	return offset + uint64(delta), nil
+}
+
+// Confirm that length bytes starting at offset fit within a buffer of size
+// bytes, without overflowing on hostile lengths
+func check_bounds(action_name string, buffer_name string, offset, length, size uint64) error {
+	if offset > size || length > size-offset {
+		return fmt.Errorf("%s out of bounds: offset %d len %d %s size %d", action_name, offset, length, buffer_name, size)
+	}
+	return nil
+}
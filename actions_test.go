@@ -0,0 +1,237 @@
+package bps
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestValidateFixtures(t *testing.T) {
+	for _, path := range []string{"test/testpatch.bps", "test/7f2e1606616492d7dfb589e8dfb70027.bps"} {
+		patchfile, _ := os.Open(path)
+		patch, err := FromFile(patchfile)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if err := patch.Validate(); err != nil {
+			t.Fatalf("Validate rejected %s: %s", path, err)
+		}
+	}
+}
+
+func TestValidateRejectsBadActions(t *testing.T) {
+	var short_output, source_underflow, target_underflow, source_past_end bytes.Buffer
+
+	write_action(&short_output, SourceRead, 4)
+
+	write_action(&source_underflow, SourceCopy, 2)
+	write_relative_offset(&source_underflow, -1)
+
+	write_action(&target_underflow, TargetRead, 1)
+	target_underflow.WriteByte('x')
+	write_action(&target_underflow, TargetCopy, 2)
+	write_relative_offset(&target_underflow, -1)
+
+	write_action(&source_past_end, SourceCopy, 4)
+	write_relative_offset(&source_past_end, 9)
+
+	cases := map[string]*BPSPatch{
+		"short output":     craft_patch(make([]byte, 10), 10, short_output.Bytes()),
+		"source underflow": craft_patch(make([]byte, 10), 10, source_underflow.Bytes()),
+		"target underflow": craft_patch(make([]byte, 10), 10, target_underflow.Bytes()),
+		"source past end":  craft_patch(make([]byte, 10), 10, source_past_end.Bytes()),
+		"truncated header": craft_patch(make([]byte, 10), 10, []byte{0x00}),
+	}
+
+	for name, patch := range cases {
+		if err := patch.Validate(); err == nil {
+			t.Fatalf("%s: Validate did not return an error", name)
+		}
+	}
+}
+
+func TestDecodeActions(t *testing.T) {
+	var encoded bytes.Buffer
+	write_action(&encoded, TargetRead, 3)
+	encoded.WriteString("abc")
+	write_action(&encoded, SourceCopy, 2)
+	write_relative_offset(&encoded, 4)
+	write_action(&encoded, TargetCopy, 2)
+	write_relative_offset(&encoded, 1)
+	write_action(&encoded, SourceCopy, 1)
+	write_relative_offset(&encoded, -3)
+	write_action(&encoded, SourceRead, 2)
+
+	patch := craft_patch(make([]byte, 10), 10, encoded.Bytes())
+
+	actions, err := patch.DecodeActions()
+	if err != nil {
+		t.Fatalf("DecodeActions returned an error: %s", err)
+	}
+
+	expected := []Action{
+		{Kind: TargetRead, Length: 3, Data: []byte("abc")},
+		{Kind: SourceCopy, Length: 2, RelativeOffset: 4},
+		{Kind: TargetCopy, Length: 2, RelativeOffset: 1},
+		{Kind: SourceCopy, Length: 1, RelativeOffset: -3},
+		{Kind: SourceRead, Length: 2},
+	}
+
+	if len(actions) != len(expected) {
+		t.Fatalf("DecodeActions returned %d actions, expected %d", len(actions), len(expected))
+	}
+
+	for i := range expected {
+		if actions[i].Kind != expected[i].Kind || actions[i].Length != expected[i].Length ||
+			actions[i].RelativeOffset != expected[i].RelativeOffset || !bytes.Equal(actions[i].Data, expected[i].Data) {
+			t.Fatalf("Action %d decoded as %+v, expected %+v", i, actions[i], expected[i])
+		}
+	}
+}
+
+func TestDecodeActionsCoversTarget(t *testing.T) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	patch, _ := FromFile(patchfile)
+
+	actions, err := patch.DecodeActions()
+	if err != nil {
+		t.Fatalf("DecodeActions returned an error: %s", err)
+	}
+
+	var total uint64
+	for _, action := range actions {
+		total += action.Length
+	}
+
+	if total != patch.TargetSize {
+		t.Fatalf("Decoded actions cover %d bytes, expected %d", total, patch.TargetSize)
+	}
+}
+
+func TestEncodeActionsRoundTrip(t *testing.T) {
+	for _, path := range []string{"test/testpatch.bps", "test/7f2e1606616492d7dfb589e8dfb70027.bps"} {
+		patchfile, _ := os.Open(path)
+		patch, _ := FromFile(patchfile)
+
+		actions, err := patch.DecodeActions()
+		if err != nil {
+			t.Fatalf("DecodeActions returned an error: %s", err)
+		}
+
+		encoded, err := EncodeActions(actions)
+		if err != nil {
+			t.Fatalf("EncodeActions returned an error: %s", err)
+		}
+
+		if !bytes.Equal(encoded, patch.Actions) {
+			t.Fatalf("EncodeActions did not reproduce the actions of %s", path)
+		}
+	}
+}
+
+func TestEncodeActionsInvalid(t *testing.T) {
+	cases := map[string]Action{
+		"unknown kind":    {Kind: 4, Length: 1},
+		"zero length":     {Kind: SourceRead},
+		"short data":      {Kind: TargetRead, Length: 4, Data: []byte("ab")},
+		"negative kind":   {Kind: -1, Length: 1},
+		"data for length": {Kind: TargetRead, Length: 1, Data: []byte("ab")},
+		"length overflow": {Kind: SourceCopy, Length: 1<<62 + 1},
+		"maximum length":  {Kind: SourceRead, Length: math.MaxUint64},
+	}
+
+	for name, action := range cases {
+		if _, err := EncodeActions([]Action{action}); err == nil {
+			t.Fatalf("%s: EncodeActions did not return an error", name)
+		}
+	}
+}
+
+func TestValidateRejectsTruncatedTrailingAction(t *testing.T) {
+	var payload_missing, payload_short, header_unterminated bytes.Buffer
+
+	write_action(&payload_missing, SourceRead, 4)
+	write_action(&payload_missing, TargetRead, 4)
+
+	write_action(&payload_short, SourceRead, 4)
+	write_action(&payload_short, TargetRead, 4)
+	payload_short.Write([]byte("ab"))
+
+	write_action(&header_unterminated, SourceRead, 4)
+	header_unterminated.WriteByte(0x00)
+
+	source := []byte("01234567")
+	for name, actions := range map[string][]byte{
+		"payload missing":     payload_missing.Bytes(),
+		"payload short":       payload_short.Bytes(),
+		"header unterminated": header_unterminated.Bytes(),
+	} {
+		patch := craft_patch(source, 8, actions)
+		if err := patch.Validate(); err == nil {
+			t.Fatalf("Validate accepted a patch with %s", name)
+		}
+		if _, err := patch.PatchSourceBytes(source); err == nil {
+			t.Fatalf("PatchSourceBytes accepted a patch with %s", name)
+		}
+	}
+}
+
+func TestSignedOffsetRoundTrip(t *testing.T) {
+	deltas := []int64{0, 1, -1, 2, -2, 63, -64, 1 << 32, -(1 << 32), math.MaxInt64, math.MinInt64 + 1}
+	for _, delta := range deltas {
+		encoded := EncodeSignedOffset(delta)
+		if decoded := DecodeSignedOffset(encoded); decoded != delta {
+			t.Fatalf("Signed offset %d encoded as %x decoded as %d", delta, encoded, decoded)
+		}
+	}
+
+	if EncodeSignedOffset(-3) != 7 || EncodeSignedOffset(3) != 6 {
+		t.Fatalf("EncodeSignedOffset does not match the spec encoding")
+	}
+
+	// Every encoding decodes, including a negative zero and the largest
+	// negative magnitude
+	if DecodeSignedOffset(1) != 0 || DecodeSignedOffset(math.MaxUint64) != math.MinInt64+1 {
+		t.Fatalf("DecodeSignedOffset edge cases incorrect")
+	}
+}
+
+func TestEncodeSignedOffsetMinInt64(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("EncodeSignedOffset did not panic for math.MinInt64")
+		}
+	}()
+	EncodeSignedOffset(math.MinInt64)
+}
+
+func TestEncodeActionsMinInt64(t *testing.T) {
+	_, err := EncodeActions([]Action{{Kind: SourceCopy, Length: 1, RelativeOffset: math.MinInt64}})
+	if err == nil {
+		t.Fatalf("EncodeActions accepted a math.MinInt64 offset")
+	}
+}
+
+func TestEncodedActionsLen(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+	actions, _ := patch.DecodeActions()
+
+	if encoded_actions_len(actions) != len(patch.Actions) {
+		t.Fatalf("encoded_actions_len predicted %d bytes, patch has %d", encoded_actions_len(actions), len(patch.Actions))
+	}
+}
+
+func TestEncodeActionsLongestAction(t *testing.T) {
+	encoded, err := EncodeActions([]Action{{Kind: TargetCopy, Length: 1 << 62}})
+	if err != nil {
+		t.Fatalf("EncodeActions rejected the longest action: %s", err)
+	}
+
+	header, _, err := bps_read_num(encoded)
+	if err != nil || header&0b11 != TargetCopy || (header>>2)+1 != 1<<62 {
+		t.Fatalf("Longest action encoded as header %x", header)
+	}
+}
@@ -0,0 +1,41 @@
+package bps
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Apply each patch to the same base, as PatchSourceBytes does, returning the
+// target and error of patches[i] in the i'th entry of each slice.  Applying
+// reads but never modifies either the patch or the base, so the patches are
+// applied concurrently on up to GOMAXPROCS goroutines, each holding one target
+// in memory at a time.  A failed patch does not stop the others.
+func ApplyBatch(base []byte, patches []*BPSPatch) ([][]byte, []error) {
+	targets := make([][]byte, len(patches))
+	errs := make([]error, len(patches))
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(patches) {
+		workers = len(patches)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				targets[i], errs[i] = patches[i].PatchSourceBytes(base)
+			}
+		}()
+	}
+
+	for i := range patches {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return targets, errs
+}
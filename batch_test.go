@@ -0,0 +1,83 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestApplyBatch(t *testing.T) {
+	base, _ := synthetic_rom(1 << 12)
+
+	var (
+		patches  []*BPSPatch
+		expected [][]byte
+	)
+	for i := 0; i < 16; i++ {
+		target := append([]byte{byte(i)}, base...)
+		patch, _ := CreatePatchDelta(base, target, EncodeOptions{})
+		patches = append(patches, patch)
+		expected = append(expected, target)
+	}
+
+	// One patch for some other source, which fails alone
+	other, _ := CreatePatchDelta([]byte("other source"), []byte("other target"), EncodeOptions{})
+	patches = append(patches, other)
+
+	targets, errs := ApplyBatch(base, patches)
+	if len(targets) != len(patches) || len(errs) != len(patches) {
+		t.Fatalf("ApplyBatch returned %d targets and %d errors for %d patches", len(targets), len(errs), len(patches))
+	}
+
+	for i := range expected {
+		if errs[i] != nil {
+			t.Fatalf("Patch %d returned an error: %s", i, errs[i])
+		}
+		if !bytes.Equal(targets[i], expected[i]) {
+			t.Fatalf("Patch %d produced the wrong target", i)
+		}
+	}
+
+	var checksum_err *ChecksumError
+	if !errors.As(errs[len(errs)-1], &checksum_err) || checksum_err.Kind != ChecksumSource {
+		t.Fatalf("Patch for another source returned %v, expected a source checksum error", errs[len(errs)-1])
+	}
+	var size_err *SourceSizeError
+	if !errors.As(errs[len(errs)-1], &size_err) {
+		t.Fatalf("Patch for another source returned %v, expected a source size error", errs[len(errs)-1])
+	}
+}
+
+func TestApplyBatchEmpty(t *testing.T) {
+	targets, errs := ApplyBatch(nil, nil)
+	if len(targets) != 0 || len(errs) != 0 {
+		t.Fatalf("ApplyBatch of no patches returned %d targets", len(targets))
+	}
+}
+
+func BenchmarkApplyBatch(b *testing.B) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	defer patchfile.Close()
+	patch, _ := FromFile(patchfile)
+
+	// Without the real ROM, a blank source stands in for it as in
+	// BenchmarkApply, with the patch changed to accept it
+	base, err := os.ReadFile("test/Zelda.sfc")
+	if err != nil {
+		base = make([]byte, patch.SourceSize)
+		patch.SourceChecksum = crc32.ChecksumIEEE(base)
+	}
+
+	patches := make([]*BPSPatch, 8)
+	for i := range patches {
+		patches[i] = &patch
+	}
+
+	b.SetBytes(int64(patch.TargetSize) * int64(len(patches)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ApplyBatch(base, patches)
+	}
+}
@@ -3,25 +3,58 @@ package bps
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
+	"io/fs"
+	"math/bits"
 	"os"
+	"unicode/utf8"
 )
 
-var (
-	bps_header = []byte("BPS1")
+// The magic header every BPS patch starts with
+const Magic = "BPS1"
+
+// Length of the footer every BPS patch ends with: the CRC32s of the source,
+// the target and the rest of the patch
+const FooterSize = 12
+
+// The smallest possible patch: the magic header, three single byte sizes and
+// the checksum footer
+const bps_min_size = len(Magic) + 3 + FooterSize
+
+// The longest encoding of a uint64: ten groups of 7 bits
+const max_varint_len = 10
+
+// The longest action a header can hold, as the length minus one shares the
+// header with the two bit action number
+const max_action_length = 1 << 62
+
+// Action numbers, as stored in the low two bits of each action header
+const (
+	SourceRead = iota
+	TargetRead
+	SourceCopy
+	TargetCopy
 )
 
 const (
-	sourceRead = iota
-	targetRead
-	sourceCopy
-	targetCopy
+	// How many actions are applied between checks for a canceled context
+	context_check_interval = 1024
+	// How many bytes are checksummed between checks for a canceled context
+	context_check_bytes = 1 << 20
 )
 
+// Action names, indexed by action number, for error messages
+var action_names = [...]string{"SourceRead", "TargetRead", "SourceCopy", "TargetCopy"}
+
+// A parsed BPS patch.  Applying a patch never modifies it, so the apply
+// methods are safe to call from several goroutines at once on a BPSPatch that
+// nothing is modifying.  Use Clone for a copy that can be changed safely.
 type BPSPatch struct {
 	SourceSize     uint64
 	TargetSize     uint64
@@ -33,134 +66,567 @@ type BPSPatch struct {
 	PatchChecksum  uint32
 }
 
+// Make a deep copy of the patch, which shares no memory with the original.
+// Editing the copy, such as with SetMetadata, leaves the original untouched.
+func (patch *BPSPatch) Clone() *BPSPatch {
+	clone := *patch
+	if patch.Actions != nil {
+		clone.Actions = append([]byte(nil), patch.Actions...)
+	}
+	return &clone
+}
+
+// Report whether two patches are identical, comparing every field including
+// the action stream.  Two nil patches are equal, but nil never equals a
+// non-nil patch.
+func (patch *BPSPatch) Equal(other *BPSPatch) bool {
+	if patch == nil || other == nil {
+		return patch == other
+	}
+
+	return patch.SourceSize == other.SourceSize &&
+		patch.TargetSize == other.TargetSize &&
+		patch.MetadataSize == other.MetadataSize &&
+		patch.Metadata == other.Metadata &&
+		bytes.Equal(patch.Actions, other.Actions) &&
+		patch.SourceChecksum == other.SourceChecksum &&
+		patch.TargetChecksum == other.TargetChecksum &&
+		patch.PatchChecksum == other.PatchChecksum
+}
+
 // Apply a BPS patch file to the specified source file.  The checksum of the
 // source file and the returned bytes will be verified and an error returned if
 // either fails
 func (patch *BPSPatch) PatchSourceFile(sourcefile *os.File) (target_data []byte, err error) {
-	// Read and validate source file
-	source_data := make([]byte, patch.SourceSize)
+	err = ApplyOptions{}.check_sizes(patch)
+	if err != nil {
+		return
+	}
+
+	err = patch.check_source_file_size(sourcefile)
+	if err != nil {
+		return
+	}
+
+	// Read and validate source file.  The source is only needed while the
+	// actions are applied, so its buffer is recycled afterwards.
+	source_data := get_source_buffer(patch.SourceSize)
+	defer put_source_buffer(source_data)
 
-	_, err = sourcefile.Read(source_data)
+	_, err = io.ReadFull(sourcefile, source_data)
 	if err != nil {
-		err = fmt.Errorf("Sourcefile Read: %w", err)
+		err = fmt.Errorf("Source file too short: wanted %d bytes: %w", patch.SourceSize, err)
 		return
 	}
 
+	return patch.PatchSourceBytes(source_data)
+}
+
+// Apply the patch to source, writing the target to dst.  The target has to be
+// assembled in memory, as TargetCopy actions read back earlier output, but it
+// is only written to dst once its checksum has been verified.
+func (patch *BPSPatch) ApplyToWriter(source io.ReaderAt, dst io.Writer) error {
+	err := ApplyOptions{}.check_sizes(patch)
+	if err != nil {
+		return err
+	}
+
+	source_data := get_source_buffer(patch.SourceSize)
+	defer put_source_buffer(source_data)
+
+	_, err = io.ReadFull(io.NewSectionReader(source, 0, int64(patch.SourceSize)), source_data)
+	if err != nil {
+		return fmt.Errorf("Source Read: %w", err)
+	}
+
+	// The write does not go through crc_writer as MarshalBinary's does: the
+	// target checksum is calculated as the actions produce the target, so
+	// there is no second pass to save, and checksumming on the way out would
+	// mean writing the target before it was verified
+	target_data, err := patch.PatchSourceBytes(source_data)
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.Write(target_data)
+	if err != nil {
+		return fmt.Errorf("Target Write: %w", err)
+	}
+
+	return nil
+}
+
+// Apply the BPS patch to source data already held in memory.  The checksum of
+// the source and the returned bytes will be verified and an error returned if
+// either fails.  When only the target checksum fails, the produced target is
+// returned along with a ChecksumError to help debug the patch.
+func (patch *BPSPatch) PatchSourceBytes(source_data []byte) (target_data []byte, err error) {
+	return patch.ApplyWithOptions(source_data, ApplyOptions{})
+}
+
+// Apply the BPS patch to source data already held in memory, as
+// PatchSourceBytes does, with control over size limits and checksum
+// verification in opts
+func (patch *BPSPatch) ApplyWithOptions(source_data []byte, opts ApplyOptions) (target_data []byte, err error) {
+	return patch.apply_bytes(context.Background(), source_data, nil, opts)
+}
+
+// Apply the BPS patch to source data already held in memory, as
+// PatchSourceBytes does, stopping early with ctx.Err() if ctx is canceled.
+// The context is checked periodically, both between actions and while
+// calculating checksums.
+func (patch *BPSPatch) ApplyContext(ctx context.Context, source_data []byte) (target_data []byte, err error) {
+	return patch.apply_bytes(ctx, source_data, nil, ApplyOptions{})
+}
+
+// Apply the BPS patch to source data already held in memory, as
+// PatchSourceBytes does, writing the target into dst rather than a newly
+// allocated slice.  dst must have capacity for TargetSize bytes, and is
+// written from its start whatever its length; reusing it across calls avoids
+// an allocation per apply.  Unlike append, a dst without the capacity is not
+// grown: nothing is written and io.ErrShortBuffer is returned, wrapped.
+// Returns the number of bytes of dst written, which is TargetSize whenever the
+// actions were all applied.
+func (patch *BPSPatch) ApplyInto(dst, source_data []byte) (int, error) {
+	err := ApplyOptions{}.check_sizes(patch)
+	if err != nil {
+		return 0, err
+	}
+
+	if uint64(cap(dst)) < patch.TargetSize {
+		return 0, fmt.Errorf("Destination has room for %d bytes, patch produces %d: %w", cap(dst), patch.TargetSize, io.ErrShortBuffer)
+	}
+
+	target_data, err := patch.apply_bytes(context.Background(), source_data, dst[:patch.TargetSize], ApplyOptions{})
+	return len(target_data), err
+}
+
+// Returned from the action walk by ApplyRange once the range is complete
+var range_complete = errors.New("Range complete")
+
+// Apply the BPS patch to source data already held in memory as
+// PatchSourceBytes does, but return only the target bytes in [start, end).
+// Actions are still processed in order up to end, as a TargetCopy may read
+// back anything before it, so this takes time in proportion to end and holds
+// end bytes of target while working, but returns only end-start bytes.  The
+// target checksum covers the whole target, so it is not verified; the source
+// checksum is.
+func (patch *BPSPatch) ApplyRange(source_data []byte, start, end uint64) ([]byte, error) {
+	if start > end || end > patch.TargetSize {
+		return nil, fmt.Errorf("Range %d to %d is outside the %d byte target", start, end, patch.TargetSize)
+	}
+
+	opts := ApplyOptions{}
+	err := opts.check_sizes(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.check_source_size(uint64(len(source_data)))
+	if err != nil {
+		return nil, err
+	}
 	calculated_source_checksum := crc32.ChecksumIEEE(source_data)
 	if calculated_source_checksum != patch.SourceChecksum {
-		err = errors.New("Source File checksum mismatch")
-		return
+		return nil, &ChecksumError{Kind: ChecksumSource, Expected: patch.SourceChecksum, Actual: calculated_source_checksum}
 	}
 
-	// Initialize target data byte slice
-	target_data = make([]byte, patch.TargetSize)
+	source := bytes.NewReader(source_data)
+	target_data := make([]byte, end)
+	output_size, err := patch.walk_actions(func(action *resolved_action) error {
+		if action.output_offset >= end {
+			return range_complete
+		}
 
-	remaining_actions := patch.Actions
+		length := action.length
+		if length > end-action.output_offset {
+			length = end - action.output_offset
+		}
+		output := target_data[action.output_offset : action.output_offset+length]
 
-	var (
-		output_offset uint64
-		source_offset uint64
-		target_offset uint64
-	)
+		switch action.action_num {
+		case SourceRead, SourceCopy:
+			err := read_source(source, output, action.read_offset)
+			if err != nil {
+				return fmt.Errorf("%s: %w", action_names[action.action_num], err)
+			}
+		case TargetRead:
+			copy(output, action.payload)
+		case TargetCopy:
+			copy_target(target_data, action.read_offset, action.output_offset, length)
+		}
+
+		return nil
+	})
+	if err == range_complete {
+		err = nil
+	} else if err == nil && output_size < end {
+		err = fmt.Errorf("Patch produced %d bytes, expected %d", output_size, patch.TargetSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), target_data[start:]...), nil
+}
+
+// Verify the source checksum and apply the patch.  When dst is not nil the
+// target is written into it, and it must be exactly TargetSize bytes long.
+func (patch *BPSPatch) apply_bytes(ctx context.Context, source_data, dst []byte, opts ApplyOptions) (target_data []byte, err error) {
+	defer func() { opts.log_apply(patch, err) }()
+
+	err = opts.check_sizes(patch)
+	if err != nil {
+		return
+	}
+
+	if !opts.SkipSourceChecksum {
+		err = patch.check_source_size(uint64(len(source_data)))
+		if err != nil {
+			return
+		}
 
-	for len(remaining_actions) > 0 {
-		var header uint64
-		header, remaining_actions, err = bps_read_num(remaining_actions)
+		var calculated_source_checksum uint32
+		calculated_source_checksum, err = checksum_context(ctx, opts.new_hash(), source_data)
 		if err != nil {
-			err = fmt.Errorf("Read Action: %w", err)
 			return
 		}
-		// First two bits of the header are the action num
-		action_num := header & 0b11
-		// Remaining bits are the length minus one
+		if calculated_source_checksum != patch.SourceChecksum {
+			err = &ChecksumError{Kind: ChecksumSource, Expected: patch.SourceChecksum, Actual: calculated_source_checksum}
+			return
+		}
+	}
+
+	// A patch embedding the whole target needs no action loop, unless
+	// something wants to see the actions go by
+	if !opts.GrowTarget && opts.OnAction == nil && opts.on_applied == nil {
+		if payloads := patch.target_read_payloads(); payloads != nil {
+			return patch.apply_target_reads(ctx, payloads, dst, opts)
+		}
+	}
+
+	return patch.apply(ctx, bytes.NewReader(source_data), &slice_actions{data: patch.Actions}, dst, opts)
+}
+
+// The payloads of a patch with no source, made only of TargetReads which
+// between them exactly cover the target, or nil for any other patch.  Only
+// the action headers are read, skipping over the payloads, so this is cheap
+// to try before applying.
+func (patch *BPSPatch) target_read_payloads() [][]byte {
+	if patch.SourceSize != 0 || patch.TargetSize == 0 {
+		return nil
+	}
+
+	var (
+		payloads [][]byte
+		covered  uint64
+	)
+	actions := patch.Actions
+	for len(actions) > 0 {
+		header, remainder, err := bps_read_num(actions)
+		if err != nil || header&0b11 != TargetRead {
+			return nil
+		}
 		length := (header >> 2) + 1
+		if length > uint64(len(remainder)) || length > patch.TargetSize-covered {
+			return nil
+		}
 
-		switch action_num {
-		case sourceRead:
-			// Copy length bytes from source file to target file, using the output offset as the index for both source and target
-			copy(target_data[output_offset:output_offset+length], source_data[output_offset:output_offset+length])
-			output_offset += length
-		case targetRead:
-			// copy length bytes from patch file to target file
-			copy(target_data[output_offset:output_offset+length], remaining_actions[:length])
-			output_offset += length
-			remaining_actions = remaining_actions[length:]
-		case sourceCopy:
-			// copy length bytes from somewhere else in the source file.  Increment or decrement the source offset before copying
-			var (
-				data uint64
-			)
-			data, remaining_actions, err = bps_read_num(remaining_actions)
-			if err != nil {
-				err = fmt.Errorf("Source copy data read: %w", err)
-				return
-			}
-			if data&1 == 1 {
-				source_offset -= data >> 1
-			} else {
-				source_offset += data >> 1
+		payloads = append(payloads, remainder[:length])
+		actions = remainder[length:]
+		covered += length
+	}
+	if covered != patch.TargetSize {
+		return nil
+	}
+
+	return payloads
+}
+
+// Apply a patch made only of the TargetRead payloads found by
+// target_read_payloads, which is just a copy of each in turn, then verify the
+// target checksum as apply does
+func (patch *BPSPatch) apply_target_reads(ctx context.Context, payloads [][]byte, dst []byte, opts ApplyOptions) (target_data []byte, err error) {
+	target_data = dst
+	if target_data == nil {
+		target_data = make([]byte, patch.TargetSize)
+	}
+
+	output := target_data
+	for _, payload := range payloads {
+		output = output[copy(output, payload):]
+	}
+
+	if opts.SkipTargetChecksum {
+		return
+	}
+
+	calculated_target_checksum, err := checksum_context(ctx, opts.new_hash(), target_data)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.check_target_checksum(patch, calculated_target_checksum)
+
+	return
+}
+
+// Apply the BPS patch to a source which is read on demand rather than held in
+// memory.  Every SourceRead and SourceCopy action becomes a ReadAt call on src,
+// so this trades many more reads (syscalls, for a file) for only ever holding
+// the target in memory.  The source checksum is verified by streaming through
+// src in chunks before any actions are applied.
+func (patch *BPSPatch) ApplyReaderAt(src io.ReaderAt) (target_data []byte, err error) {
+	err = ApplyOptions{}.check_sizes(patch)
+	if err != nil {
+		return
+	}
+
+	err = patch.VerifySource(io.NewSectionReader(src, 0, int64(patch.SourceSize)))
+	if err != nil {
+		return
+	}
+
+	return patch.apply(context.Background(), src, &slice_actions{data: patch.Actions}, nil, ApplyOptions{})
+}
+
+// Run the patch actions, reading source data from source as required, and
+// verify the checksum of the produced target unless opts says otherwise.  The
+// actions are read from actions, which is normally the patch's own Actions.
+// The target is written to dst if it is not nil, otherwise to a new slice.
+func (patch *BPSPatch) apply(ctx context.Context, source io.ReaderAt, actions action_stream, dst []byte, opts ApplyOptions) (target_data []byte, err error) {
+	// Initialize target data byte slice, unless it is to be grown as the
+	// actions are applied
+	target_limit := patch.TargetSize
+	switch {
+	case opts.GrowTarget:
+		target_limit = opts.max_target_size()
+		target_data = dst[:0]
+	case dst != nil:
+		target_data = dst
+	default:
+		target_data = make([]byte, patch.TargetSize)
+	}
+
+	// The target is written strictly in order, so its checksum can be
+	// calculated as each action completes instead of in a second pass
+	var (
+		actions_applied int
+		target_checksum hash.Hash32
+	)
+	if !opts.SkipTargetChecksum {
+		target_checksum = opts.new_hash()
+	}
+	output_size, err := patch.walk_actions_within(actions, target_limit, func(action *resolved_action) error {
+		actions_applied++
+		if actions_applied%context_check_interval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
 			}
-			copy(target_data[output_offset:output_offset+length], source_data[source_offset:source_offset+length])
-			source_offset += length
-			output_offset += length
-		case targetCopy:
-			// copy data from somewhere else in the target file.  Increment or decrement the target offset before copying
-			var (
-				data uint64
-			)
-			data, remaining_actions, err = bps_read_num(remaining_actions)
+		}
+
+		if opts.GrowTarget {
+			target_data = extend(target_data, action.length)
+		}
+
+		output := target_data[action.output_offset : action.output_offset+action.length]
+
+		switch action.action_num {
+		case SourceRead, SourceCopy:
+			err := read_source(source, output, action.read_offset)
 			if err != nil {
-				err = fmt.Errorf("Target Copy Read %w", err)
-				return
-			}
-			if data&1 == 1 {
-				target_offset -= data >> 1
-			} else {
-				target_offset += data >> 1
-			}
-			// sadly, cannot use copy for this, because we might be copying from areas we haven't written yet
-			for length > 0 {
-				target_data[output_offset] = target_data[target_offset]
-				output_offset += 1
-				target_offset += 1
-				length--
+				return fmt.Errorf("%s: %w", action_names[action.action_num], err)
 			}
+		case TargetRead:
+			copy(output, action.payload)
+		case TargetCopy:
+			copy_target(target_data, action.read_offset, action.output_offset, action.length)
+		}
+
+		if !opts.SkipTargetChecksum {
+			target_checksum.Write(output)
+		}
+
+		if opts.OnAction != nil {
+			opts.OnAction(int(action.action_num), action.output_offset, action.length)
+		}
+		if opts.on_applied != nil {
+			opts.on_applied(action)
 		}
 
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Over filling the target is caught by the bounds checks, unless it is
+	// being grown, but under filling it would otherwise only show up as a
+	// checksum mismatch
+	if output_size != patch.TargetSize {
+		return nil, fmt.Errorf("Patch produced %d bytes, expected %d", output_size, patch.TargetSize)
 	}
 
-	calculated_target_checksum := crc32.ChecksumIEEE(target_data)
-	if calculated_target_checksum != patch.TargetChecksum {
-		// This is likely a bug in the implementation, if we hit it
-		err = errors.New("Target Checksum mismatch.")
+	if opts.SkipTargetChecksum {
+		return
 	}
 
+	// On a mismatch the produced target is still returned alongside the
+	// error, so it can be compared against the expected output
+	err = opts.check_target_checksum(patch, target_checksum.Sum32())
+
 	return
 
 }
 
+// Lengthen data by length bytes, reallocating with room to spare when its
+// capacity runs out so that growing one action at a time stays cheap
+func extend(data []byte, length uint64) []byte {
+	needed := uint64(len(data)) + length
+	if needed > uint64(cap(data)) {
+		new_cap := 2 * uint64(cap(data))
+		if new_cap < needed {
+			new_cap = needed
+		}
+		grown := make([]byte, len(data), new_cap)
+		copy(grown, data)
+		data = grown
+	}
+	return data[:needed]
+}
+
+// Calculate the checksum of data in chunks, checking ctx between chunks so
+// that checksumming a large file can be canceled
+func checksum_context(ctx context.Context, checksum hash.Hash32, data []byte) (uint32, error) {
+	for len(data) > 0 {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		chunk := data
+		if len(chunk) > context_check_bytes {
+			chunk = chunk[:context_check_bytes]
+		}
+		checksum.Write(chunk)
+		data = data[len(chunk):]
+	}
+
+	return checksum.Sum32(), nil
+}
+
+// Copy length bytes of earlier target data starting at read_offset to
+// output_offset.  The ranges may overlap, in which case bytes written by the
+// copy are themselves copied again.
+func copy_target(target_data []byte, read_offset, output_offset, length uint64) {
+	output := target_data[output_offset : output_offset+length]
+
+	switch {
+	case read_offset+length <= output_offset:
+		// The ranges don't overlap, so this is an ordinary copy
+		copy(output, target_data[read_offset:])
+	case output_offset-read_offset == 1:
+		// Run length encoding of a single byte.  Fill by repeatedly doubling
+		// the filled region.
+		output[0] = target_data[read_offset]
+		for filled := 1; filled < len(output); filled *= 2 {
+			copy(output[filled:], output[:filled])
+		}
+	default:
+		// sadly, cannot use copy for this, because we might be copying from areas we haven't written yet
+		for i := range output {
+			output[i] = target_data[read_offset]
+			read_offset += 1
+		}
+	}
+}
+
+// Fill dst with source data starting at offset.  io.ReaderAt may report EOF
+// alongside a complete read at the very end of the source, which is fine.
+func read_source(source io.ReaderAt, dst []byte, offset uint64) error {
+	read, err := source.ReadAt(dst, int64(offset))
+	if read == len(dst) {
+		return nil
+	}
+	return err
+}
+
+// Read a BPS patch file from disk.  The whole file is read into memory and
+// parsed with FromBytes, so must run from Magic through to the FooterSize
+// byte checksum footer with nothing trailing it
 func FromFile(patchfile *os.File) (patch BPSPatch, err error) {
 	filestat, err := patchfile.Stat()
 	if err != nil {
 		err = fmt.Errorf("Error performing stat on patchfile: %w", err)
+		return
 	}
 	filesize := filestat.Size()
+	if int64(int(filesize)) != filesize {
+		err = fmt.Errorf("Patchfile is %d bytes: %w", filesize, ErrPlatformTooLarge)
+		return
+	}
 
 	full_file := make([]byte, filesize)
-	patchfile.Read(full_file)
+	_, err = io.ReadFull(patchfile, full_file)
+	if err != nil {
+		err = fmt.Errorf("Error reading patchfile: wanted %d bytes: %w", filesize, err)
+		return
+	}
 
 	return FromBytes(full_file)
 }
 
-// Read a BPS patch file, verifying the patch checksum
+// Read a BPS patch from a stream, such as stdin or a network connection.  The
+// stream is read to EOF and parsed with FromBytes
+func FromReader(r io.Reader) (patch BPSPatch, err error) {
+	return FromReaderOpts(r, ReadOptions{})
+}
+
+// Read a BPS patch from a stream as FromReader does, with control over parsing
+// in opts
+func FromReaderOpts(r io.Reader, opts ReadOptions) (patch BPSPatch, err error) {
+	full_file, err := io.ReadAll(r)
+	if err != nil {
+		err = fmt.Errorf("Error reading patch stream: %w", err)
+		return
+	}
+
+	return FromBytesOpts(full_file, opts)
+}
+
+// Read the named BPS patch file from fsys, such as an embed.FS or os.DirFS.
+// The whole file is read into memory and parsed with FromBytes
+func FromFS(fsys fs.FS, name string) (patch BPSPatch, err error) {
+	patchfile, err := fsys.Open(name)
+	if err != nil {
+		err = fmt.Errorf("Error opening patchfile: %w", err)
+		return
+	}
+	defer patchfile.Close()
+
+	return FromReader(patchfile)
+}
+
+// Read a BPS patch file, verifying the patch checksum.  The returned patch's
+// Actions shares memory with full_file, see ReadOptions.CopyActions.
 func FromBytes(full_file []byte) (patch BPSPatch, err error) {
-	if !bytes.Equal(full_file[:len(bps_header)], bps_header) {
-		return BPSPatch{}, errors.New("Magic Header Incorrect")
+	return FromBytesOpts(full_file, ReadOptions{})
+}
+
+// Read a BPS patch file as FromBytes does, with control over parsing in opts
+func FromBytesOpts(full_file []byte, opts ReadOptions) (patch BPSPatch, err error) {
+	defer func() { opts.log_read(&patch, err) }()
+
+	// The magic is checked first, as other patch formats can be shorter
+	// than any BPS patch
+	if !bytes.HasPrefix(full_file, []byte(Magic)) {
+		return BPSPatch{}, magic_error(full_file)
+	}
+
+	if len(full_file) < bps_min_size {
+		return BPSPatch{}, fmt.Errorf("Patch too short: %d bytes, a valid patch is at least %d", len(full_file), bps_min_size)
 	}
 
-	remaining := full_file[len(bps_header):]
+	remaining := full_file[len(Magic):]
 
-	// TODO: error handling
 	source_size, remaining, err := bps_read_num(remaining)
 	if err != nil {
 		err = fmt.Errorf("Error reading source size: %w", err)
@@ -170,25 +636,43 @@ func FromBytes(full_file []byte) (patch BPSPatch, err error) {
 	target_size, remaining, err := bps_read_num(remaining)
 	if err != nil {
 		err = fmt.Errorf("Error reading target size: %w", err)
+		return
 	}
 
 	metadata_size, remaining, err := bps_read_num(remaining)
 	if err != nil {
 		err = fmt.Errorf("Error reading metadata size: %w", err)
+		return
 	}
 
+	if metadata_size > uint64(len(remaining)) {
+		return BPSPatch{}, fmt.Errorf("Metadata size %d larger than the %d bytes remaining", metadata_size, len(remaining))
+	}
 	metadata, remaining := string(remaining[:metadata_size]), remaining[metadata_size:]
 
-	action_len := len(remaining) - 12
+	if len(remaining) < FooterSize {
+		return BPSPatch{}, fmt.Errorf("Patch truncated: %d bytes after the metadata, the checksum footer alone needs %d", len(remaining), FooterSize)
+	}
+	action_len := len(remaining) - FooterSize
 	actions, remaining := remaining[:action_len], remaining[action_len:]
 
 	source_checksum := binary.LittleEndian.Uint32(remaining[:4])
 	target_checksum := binary.LittleEndian.Uint32(remaining[4:8])
 	patch_checksum := binary.LittleEndian.Uint32(remaining[8:12])
 
-	calculated_patch_checksum := crc32.ChecksumIEEE(full_file[:len(full_file)-4])
-	if calculated_patch_checksum != patch_checksum {
-		return BPSPatch{}, errors.New("Patch checksum did not verify")
+	if !opts.SkipPatchChecksum {
+		err = verify_patch_checksum(full_file, opts.new_hash())
+		if err != nil {
+			return BPSPatch{}, err
+		}
+	}
+
+	if !opts.AllowInvalidMetadata && !utf8.ValidString(metadata) {
+		return BPSPatch{}, errors.New("Patch metadata is not valid UTF-8")
+	}
+
+	if opts.CopyActions {
+		actions = append([]byte(nil), actions...)
 	}
 
 	return BPSPatch{
@@ -204,11 +688,87 @@ func FromBytes(full_file []byte) (patch BPSPatch, err error) {
 
 }
 
-// Serialize a uint64 into a BPS variable length encoded byte stream Should
-// probably switch to return bytes at some point?  Mostly this is used for test
-// cases ATM
-func bps_write_num(bytewriter io.ByteWriter, num uint64) error {
-	for true {
+// Serialize the patch into the BPS file format, implementing
+// encoding.BinaryMarshaler.  The metadata size is taken from the length of
+// Metadata, and the patch checksum is recalculated over the serialized bytes
+// and stored back into PatchChecksum so the struct matches its serialization.
+func (patch *BPSPatch) MarshalBinary() ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		num [max_varint_len]byte
+	)
+
+	// Everything but the patch checksum itself is written through out, so
+	// the checksum is ready as soon as the rest is
+	out := &crc_writer{w: &buf}
+	io.WriteString(out, Magic)
+	out.Write(AppendNum(num[:0], patch.SourceSize))
+	out.Write(AppendNum(num[:0], patch.TargetSize))
+	out.Write(AppendNum(num[:0], uint64(len(patch.Metadata))))
+	io.WriteString(out, patch.Metadata)
+	out.Write(patch.Actions)
+	binary.Write(out, binary.LittleEndian, patch.SourceChecksum)
+	binary.Write(out, binary.LittleEndian, patch.TargetChecksum)
+
+	patch.PatchChecksum = out.crc
+	binary.Write(&buf, binary.LittleEndian, patch.PatchChecksum)
+
+	return buf.Bytes(), nil
+}
+
+// Write the serialized patch to w, implementing io.WriterTo.  As with
+// MarshalBinary, the patch checksum is recalculated so a patch with modified
+// metadata or actions is still written out as a valid file
+func (patch *BPSPatch) WriteTo(w io.Writer) (int64, error) {
+	serialized, err := patch.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := w.Write(serialized)
+	return int64(written), err
+}
+
+// Write the serialized patch to the file at path, replacing anything already
+// there.  As with ApplyFile, the patch is written to path + ".tmp" and renamed
+// into place, so a failed write never leaves a truncated patch behind.
+func (patch *BPSPatch) WriteToFile(path string) error {
+	err := write_file_atomic(path, func(output *os.File) error {
+		_, err := patch.WriteTo(output)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing patchfile: %w", err)
+	}
+
+	return nil
+}
+
+// Serialize a uint64 into a BPS variable length encoded byte stream, as used
+// for every number in a BPS patch.
+//
+// Each byte holds the next lowest 7 bits of the number, with the high bit set
+// on the final byte.  Unlike a plain LEB128 style varint, one is subtracted
+// from the remaining number after each non-final byte is written, and the
+// decoder adds it back (the "+1 carry").  This gives every number exactly one
+// encoding: without it, 1 could be written as either 0x81 or 0x01 0x80.
+func WriteNum(bytewriter io.ByteWriter, num uint64) error {
+	var encoded [max_varint_len]byte
+	for _, x := range AppendNum(encoded[:0], num) {
+		err := bytewriter.WriteByte(x)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append the BPS variable length encoding of num to dst and return the
+// extended slice, in the style of strconv.AppendInt.  The encoding is the same
+// as WriteNum's.
+func AppendNum(dst []byte, num uint64) []byte {
+	for {
 		// slice off the lowest 7 bits of num
 		x := byte(num & 0x7f)
 		// shift the lowest 7 bits out of the num
@@ -217,33 +777,35 @@ func bps_write_num(bytewriter io.ByteWriter, num uint64) error {
 		// If we've encoded all bits of the number into either x or the byte
 		// stream, write out x with the end of number bit set
 		if num == 0 {
-			err := bytewriter.WriteByte(0x80 | x)
-			if err != nil {
-				return err
-			}
-			break
+			return append(dst, 0x80|x)
 		}
 
 		// Otherwise, write out the byte and loop around
-		bytewriter.WriteByte(x)
+		dst = append(dst, x)
 
-		// weird optimization for "one"?
-		// I don't understand the purpose of this optimization, and the
-		// reference decode implementation doesn't seem to handle this
-		// optimization at all, and every other bps impl I've seen doesn't do
-		// this either
+		// The +1 carry: a continuation byte always implies at least one more
+		// unit in the higher bits, so that unit is not encoded again
 		num--
 	}
+}
 
-	return nil
+// Report how many bytes WriteNum and AppendNum encode num in, from 1 for
+// numbers below 128 up to 10 for the largest
+func VarintLen(num uint64) int {
+	length := 1
+	// Each continuation byte carries 7 bits, less the +1 carry
+	for num >>= 7; num != 0; num >>= 7 {
+		num--
+		length++
+	}
+	return length
 }
 
-// Read a BPS serialized variable length encoded integer from the provided byte slice.
-func bps_read_num(stream []byte) (data uint64, remainder []byte, err error) {
-	var (
-		bytes_read int    = 0
-		shift      uint64 = 1
-	)
+// Read a BPS serialized variable length encoded integer from the provided byte
+// slice, returning the value, the bytes following it and how many bytes the
+// number took up.  See WriteNum for a description of the encoding.
+func ReadNum(stream []byte) (data uint64, remainder []byte, bytes_read int, err error) {
+	var shift uint64 = 1
 
 	for bytes_read < len(stream) {
 		// Grab the next byte and indicate we read one.
@@ -251,23 +813,53 @@ func bps_read_num(stream []byte) (data uint64, remainder []byte, err error) {
 		bytes_read++
 
 		// Mask off the eigth bit.  Multiply the remaining 7 bits by the shift,
-		// and add into our data parameter.
-		data += uint64((x & 0x7f)) * shift
+		// and add into our data parameter.  Only the final byte of a ten
+		// byte number can overflow, but a hostile patch can make it do so.
+		high, bits_value := bits.Mul64(uint64(x&0x7f), shift)
+		var carry uint64
+		data, carry = bits.Add64(data, bits_value, 0)
+		if high != 0 || carry != 0 {
+			err = errors.New("bps_read_num: varint overflows 64 bits")
+			return
+		}
 
 		// If the 8th bit is set, we've reached end of number
 		if (x & 0x80) == 0x80 {
 			remainder = stream[bytes_read:]
 			return
 		}
+
+		// A uint64 needs at most ten bytes, so any more can only be an
+		// attempt to loop here forever
+		if bytes_read == max_varint_len {
+			err = errors.New("bps_read_num: varint too long")
+			return
+		}
+
 		// Increase the shift so that further reads represent higher bits in the read number
 		shift <<= 7
 
-		// I think this has to do with the way the encoding subtracts one from
-		// the data as it goes, so you add "one" as we go?  But what about the first one?
-		data += shift
+		// The +1 carry: add back the unit the encoder subtracted after
+		// writing this continuation byte
+		data, carry = bits.Add64(data, shift, 0)
+		if carry != 0 {
+			err = errors.New("bps_read_num: varint overflows 64 bits")
+			return
+		}
 	}
 
 	err = errors.New("bps_read_num: Ran out of bytes before termination bit was set")
 
 	return
 }
+
+// Serialize a uint64 into a BPS variable length encoded byte stream
+func bps_write_num(bytewriter io.ByteWriter, num uint64) error {
+	return WriteNum(bytewriter, num)
+}
+
+// Read a BPS serialized variable length encoded integer from the provided byte slice.
+func bps_read_num(stream []byte) (data uint64, remainder []byte, err error) {
+	data, remainder, _, err = ReadNum(stream)
+	return
+}
@@ -2,8 +2,16 @@ package bps
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func compare_bps(expected *BPSPatch, actual *BPSPatch, t *testing.T) {
@@ -220,3 +228,1058 @@ func TestEndToEndALTPPRBase(t *testing.T) {
 
 	// If the checksum passes, it's good
 }
+
+func TestFromBytesMatchesFromFile(t *testing.T) {
+	expected_bps := BPSPatch{
+		SourceSize:     45,
+		TargetSize:     92,
+		MetadataSize:   0,
+		Metadata:       "",
+		SourceChecksum: 0x133070d,
+		TargetChecksum: 0x76c91265,
+		PatchChecksum:  0xc18e4db1,
+	}
+
+	data, err := os.ReadFile("test/testpatch.bps")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	bps, err := FromBytes(data)
+	if err != nil {
+		t.Fatalf("FromBytes returned an error: %s", err)
+	}
+
+	compare_bps(&expected_bps, &bps, t)
+
+	f, _ := os.Open("test/testpatch.bps")
+	from_file, _ := FromFile(f)
+	if !bytes.Equal(bps.Actions, from_file.Actions) {
+		t.Fatalf("FromBytes and FromFile parsed different actions")
+	}
+}
+
+func TestFromBytesOptsCopyActions(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+
+	shared, _ := FromBytes(data)
+	copied, err := FromBytesOpts(data, ReadOptions{CopyActions: true})
+	if err != nil {
+		t.Fatalf("FromBytesOpts returned an error: %s", err)
+	}
+
+	if !bytes.Equal(shared.Actions, copied.Actions) {
+		t.Fatalf("FromBytesOpts actions differ from FromBytes")
+	}
+
+	shared.Actions[0] ^= 0xff
+	if shared.Actions[0] != data[len(data)-12-len(shared.Actions)] {
+		t.Fatalf("FromBytes actions do not share memory with the input")
+	}
+	if copied.Actions[0] == shared.Actions[0] {
+		t.Fatalf("CopyActions actions share memory with the input")
+	}
+}
+
+func TestFromFileClosedFile(t *testing.T) {
+	f, _ := os.Open("test/testpatch.bps")
+	f.Close()
+
+	_, err := FromFile(f)
+	if err == nil {
+		t.Fatalf("FromFile did not return an error for a closed file")
+	}
+}
+
+func TestFromReader(t *testing.T) {
+	expected_bps := BPSPatch{
+		SourceSize:     45,
+		TargetSize:     92,
+		MetadataSize:   0,
+		Metadata:       "",
+		SourceChecksum: 0x133070d,
+		TargetChecksum: 0x76c91265,
+		PatchChecksum:  0xc18e4db1,
+	}
+
+	data, _ := os.ReadFile("test/testpatch.bps")
+
+	bps, err := FromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("FromReader returned an error: %s", err)
+	}
+
+	compare_bps(&expected_bps, &bps, t)
+}
+
+func TestFromReaderOptsSkipPatchChecksum(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	data[len(data)-1] ^= 0xff
+
+	var checksum_err *ChecksumError
+	if _, err := FromReaderOpts(bytes.NewReader(data), ReadOptions{}); !errors.As(err, &checksum_err) {
+		t.Fatalf("FromReaderOpts did not verify the patch checksum by default: %v", err)
+	}
+
+	bps, err := FromReaderOpts(bytes.NewReader(data), ReadOptions{SkipPatchChecksum: true})
+	if err != nil {
+		t.Fatalf("FromReaderOpts with SkipPatchChecksum returned an error: %s", err)
+	}
+	if bps.PatchChecksum != 0xc18e4db1^0xff000000 {
+		t.Fatalf("FromReaderOpts did not read the stored patch checksum: %08x", bps.PatchChecksum)
+	}
+}
+
+func TestFromFS(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	expected, _ := FromBytes(data)
+
+	filesystems := map[string]fs.FS{
+		"DirFS": os.DirFS("test"),
+		"MapFS": fstest.MapFS{"testpatch.bps": &fstest.MapFile{Data: data}},
+	}
+
+	for name, fsys := range filesystems {
+		bps, err := FromFS(fsys, "testpatch.bps")
+		if err != nil {
+			t.Fatalf("FromFS on a %s returned an error: %s", name, err)
+		}
+		compare_bps(&expected, &bps, t)
+
+		if _, err := FromFS(fsys, "missing.bps"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("FromFS on a %s did not report a missing file: %v", name, err)
+		}
+	}
+}
+
+func TestFromReaderTooShort(t *testing.T) {
+	_, err := FromReader(bytes.NewReader([]byte("BPS1\x80\x80\x80")))
+	if err == nil {
+		t.Fatalf("FromReader did not reject a truncated patch")
+	}
+}
+
+func TestFromBytesTruncated(t *testing.T) {
+	zeros := func(n int) string { return string(make([]byte, n)) }
+
+	// Each patch is long enough to pass the minimum size check, but runs out
+	// at a different point in the header
+	cases := map[string]struct{ data, err string }{
+		"source size":   {"BPS1" + zeros(15), "Error reading source size"},
+		"target size":   {"BPS1\x80" + zeros(14), "Error reading target size"},
+		"metadata size": {"BPS1\x80\x80" + zeros(13), "Error reading metadata size"},
+		"metadata":      {"BPS1\x80\x80\xe4" + zeros(12), "Metadata size 100 larger than the 12 bytes remaining"},
+		"footer":        {"BPS1\x80\x80\x8a" + zeros(12), "Patch truncated: 2 bytes after the metadata"},
+	}
+
+	for name, c := range cases {
+		_, err := FromBytes([]byte(c.data))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("FromBytes with truncated %s returned %v, expected %q", name, err, c.err)
+		}
+	}
+}
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	for _, path := range []string{"test/testpatch.bps", "test/7f2e1606616492d7dfb589e8dfb70027.bps"} {
+		data, _ := os.ReadFile(path)
+		bps, err := FromBytes(data)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		serialized, err := bps.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary returned an error: %s", err)
+		}
+
+		if !bytes.Equal(serialized, data) {
+			t.Fatalf("MarshalBinary of %s did not reproduce the original file", path)
+		}
+
+		reparsed, err := FromBytes(serialized)
+		if err != nil {
+			t.Fatalf("FromBytes could not parse MarshalBinary output: %s", err)
+		}
+
+		if !bps.Equal(&reparsed) {
+			t.Fatalf("%s did not round trip", path)
+		}
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	f, _ := os.Open("test/testpatch.bps")
+	bps, err := FromFile(f)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Changing the metadata invalidates the old patch checksum
+	bps.Metadata = "rewritten"
+	bps.MetadataSize = uint64(len(bps.Metadata))
+
+	path := t.TempDir() + "/rewritten.bps"
+	if err := bps.WriteToFile(path); err != nil {
+		t.Fatalf("WriteToFile returned an error: %s", err)
+	}
+
+	written, _ := os.Open(path)
+	defer written.Close()
+	reread, err := FromFile(written)
+	if err != nil {
+		t.Fatalf("Could not read back written patch: %s", err)
+	}
+
+	compare_bps(&bps, &reread, t)
+}
+
+func TestWriteToCount(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	bps, _ := FromBytes(data)
+
+	var buf bytes.Buffer
+	written, err := bps.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo returned an error: %s", err)
+	}
+
+	if written != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("WriteTo wrote %d bytes, expected %d", written, len(data))
+	}
+}
+
+func TestApplyToWriter(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	patch, err := FromFile(patchfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var target bytes.Buffer
+	err = patch.ApplyToWriter(bytes.NewReader(sourcedata), &target)
+	if err != nil {
+		t.Fatalf("ApplyToWriter returned an error: %s", err)
+	}
+
+	if !bytes.Equal(expectedtargetdata, target.Bytes()) {
+		t.Fatalf("Expected target data does not match target data")
+	}
+}
+
+func TestApplyToWriterWrongSource(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	var target bytes.Buffer
+	err := patch.ApplyToWriter(bytes.NewReader(make([]byte, patch.SourceSize)), &target)
+	if err == nil {
+		t.Fatalf("ApplyToWriter accepted the wrong source")
+	}
+
+	if target.Len() != 0 {
+		t.Fatalf("ApplyToWriter wrote %d bytes despite failing", target.Len())
+	}
+}
+
+func TestPatchSourceBytes(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	patch, err := FromFile(patchfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	targetdata, err := patch.PatchSourceBytes(sourcedata)
+	if err != nil {
+		t.Fatalf("PatchSourceBytes returned an error: %s", err)
+	}
+
+	if !bytes.Equal(expectedtargetdata, targetdata) {
+		t.Fatalf("Expected target data does not match target data")
+	}
+
+	_, err = patch.PatchSourceBytes(expectedtargetdata[:patch.SourceSize])
+	if err == nil {
+		t.Fatalf("PatchSourceBytes accepted the wrong source")
+	}
+}
+
+func TestApplyReaderAt(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcefile, _ := os.Open("test/sourceFile")
+	defer sourcefile.Close()
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	patch, err := FromFile(patchfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	targetdata, err := patch.ApplyReaderAt(sourcefile)
+	if err != nil {
+		t.Fatalf("ApplyReaderAt returned an error: %s", err)
+	}
+
+	if !bytes.Equal(expectedtargetdata, targetdata) {
+		t.Fatalf("Expected target data does not match target data")
+	}
+
+	_, err = patch.ApplyReaderAt(bytes.NewReader(expectedtargetdata))
+	if err == nil {
+		t.Fatalf("ApplyReaderAt accepted the wrong source")
+	}
+}
+
+func BenchmarkApplySource(b *testing.B) {
+	source, target := synthetic_rom(1 << 20)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	path := b.TempDir() + "/source"
+	os.WriteFile(path, source, 0644)
+	sourcefile, _ := os.Open(path)
+	defer sourcefile.Close()
+
+	b.Run("bytes", func(b *testing.B) {
+		b.SetBytes(int64(patch.TargetSize))
+		for i := 0; i < b.N; i++ {
+			if _, err := patch.PatchSourceBytes(source); err != nil {
+				b.Fatalf("%s", err)
+			}
+		}
+	})
+
+	b.Run("readerat", func(b *testing.B) {
+		b.SetBytes(int64(patch.TargetSize))
+		for i := 0; i < b.N; i++ {
+			if _, err := patch.ApplyReaderAt(sourcefile); err != nil {
+				b.Fatalf("%s", err)
+			}
+		}
+	})
+}
+
+func TestPatchSourceFileTruncatedSource(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+
+	patch, err := FromFile(patchfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	path := t.TempDir() + "/truncated"
+	os.WriteFile(path, sourcedata[:20], 0644)
+	sourcefile, _ := os.Open(path)
+	defer sourcefile.Close()
+
+	_, err = patch.PatchSourceFile(sourcefile)
+	var size_err *SourceSizeError
+	if !errors.As(err, &size_err) || size_err.Actual != 20 || size_err.Expected != patch.SourceSize {
+		t.Fatalf("PatchSourceFile did not report the short source: %v", err)
+	}
+}
+
+// Build a patch around hand encoded actions, with a valid source checksum so
+// that application gets as far as running the actions
+func craft_patch(source []byte, target_size uint64, actions []byte) *BPSPatch {
+	return &BPSPatch{
+		SourceSize:     uint64(len(source)),
+		TargetSize:     target_size,
+		Actions:        actions,
+		SourceChecksum: crc32.ChecksumIEEE(source),
+	}
+}
+
+func TestApplyRejectsOutOfBoundsActions(t *testing.T) {
+	source := []byte("0123456789")
+
+	var over_long_target, over_long_source, source_copy_past_end, target_copy_ahead, target_read_short bytes.Buffer
+
+	write_action(&over_long_target, TargetRead, 20)
+	over_long_target.Write(make([]byte, 20))
+
+	write_action(&over_long_source, SourceRead, 11)
+
+	write_action(&source_copy_past_end, SourceCopy, 4)
+	write_relative_offset(&source_copy_past_end, 8)
+
+	write_action(&target_copy_ahead, TargetRead, 1)
+	target_copy_ahead.WriteByte('x')
+	write_action(&target_copy_ahead, TargetCopy, 4)
+	write_relative_offset(&target_copy_ahead, 1)
+
+	write_action(&target_read_short, TargetRead, 8)
+	target_read_short.Write([]byte("abc"))
+
+	cases := map[string]*BPSPatch{
+		"over long target":     craft_patch(source, 10, over_long_target.Bytes()),
+		"over long source":     craft_patch(source, 20, over_long_source.Bytes()),
+		"SourceCopy past end":  craft_patch(source, 10, source_copy_past_end.Bytes()),
+		"TargetCopy ahead":     craft_patch(source, 10, target_copy_ahead.Bytes()),
+		"TargetRead truncated": craft_patch(source, 10, target_read_short.Bytes()),
+	}
+
+	for name, patch := range cases {
+		_, err := patch.PatchSourceBytes(source)
+		if err == nil {
+			t.Fatalf("%s: PatchSourceBytes did not return an error", name)
+		}
+	}
+}
+
+func TestApplyTruncatedAndMangledActions(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromFile(patchfile)
+
+	// Every truncation of the action stream must fail cleanly rather than panic
+	for i := 0; i < len(patch.Actions); i++ {
+		truncated := patch
+		truncated.Actions = patch.Actions[:i]
+		truncated.PatchSourceBytes(sourcedata)
+	}
+
+	over_long := patch
+	over_long.Actions = append(append([]byte{}, patch.Actions...), patch.Actions...)
+	if _, err := over_long.PatchSourceBytes(sourcedata); err == nil {
+		t.Fatalf("Doubled action stream did not return an error")
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		mangled := patch
+		mangled.Actions = append([]byte{}, patch.Actions...)
+		mangled.Actions[random.Intn(len(mangled.Actions))] = byte(random.Intn(256))
+		mangled.PatchSourceBytes(sourcedata)
+	}
+}
+
+func TestReadNumReportsLength(t *testing.T) {
+	var writeBuffer bytes.Buffer
+	WriteNum(&writeBuffer, 0xdeadbeef)
+	writeBuffer.WriteString("rest")
+
+	value, rest, n, err := ReadNum(writeBuffer.Bytes())
+	if err != nil {
+		t.Fatalf("ReadNum returned an error: %s", err)
+	}
+
+	if value != 0xdeadbeef || string(rest) != "rest" || n != writeBuffer.Len()-4 {
+		t.Fatalf("ReadNum returned %x, %q, %d", value, rest, n)
+	}
+}
+
+func TestReadNumUnambiguous(t *testing.T) {
+	// Thanks to the +1 carry, 0x01 0x80 is 129 rather than a second way of writing 1
+	value, _, _, err := ReadNum([]byte{0x01, 0x80})
+	if err != nil {
+		t.Fatalf("ReadNum returned an error: %s", err)
+	}
+
+	if value != 129 {
+		t.Fatalf("ReadNum decoded 0x01 0x80 as %d", value)
+	}
+}
+
+func TestTargetCopyOverlapPatterns(t *testing.T) {
+	// A repeating three byte pattern, non overlapping, and single byte RLE
+	actions, _ := EncodeActions([]Action{
+		{Kind: TargetRead, Length: 3, Data: []byte("abc")},
+		{Kind: TargetCopy, Length: 6, RelativeOffset: 0},
+		{Kind: TargetCopy, Length: 3, RelativeOffset: -6},
+		{Kind: TargetCopy, Length: 4, RelativeOffset: 8},
+	})
+	expected := []byte("abcabcabcabccccc")
+
+	patch := craft_patch(nil, uint64(len(expected)), actions)
+	patch.TargetChecksum = crc32.ChecksumIEEE(expected)
+
+	targetdata, err := patch.PatchSourceBytes(nil)
+	if err != nil {
+		t.Fatalf("PatchSourceBytes returned an error: %s", err)
+	}
+
+	if !bytes.Equal(targetdata, expected) {
+		t.Fatalf("TargetCopy produced %q, expected %q", targetdata, expected)
+	}
+}
+
+// Build a patch from actions alone, calculating the target checksum by
+// applying it
+func bench_patch(b *testing.B, target_size uint64, actions []Action) *BPSPatch {
+	encoded, err := EncodeActions(actions)
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+
+	patch := craft_patch(nil, target_size, encoded)
+	targetdata, _ := patch.PatchSourceBytes(nil)
+	patch.TargetChecksum = crc32.ChecksumIEEE(targetdata)
+
+	return patch
+}
+
+func BenchmarkTargetCopy(b *testing.B) {
+	const size = 1 << 20
+
+	b.Run("rle", func(b *testing.B) {
+		patch := bench_patch(b, size, []Action{
+			{Kind: TargetRead, Length: 1, Data: []byte{0xff}},
+			{Kind: TargetCopy, Length: size - 1},
+		})
+		b.SetBytes(size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			patch.PatchSourceBytes(nil)
+		}
+	})
+
+	b.Run("non-overlapping", func(b *testing.B) {
+		block := make([]byte, 4096)
+		rand.New(rand.NewSource(1)).Read(block)
+		actions := []Action{{Kind: TargetRead, Length: uint64(len(block)), Data: block}}
+		for i := len(block); i < size; i += len(block) {
+			actions = append(actions, Action{Kind: TargetCopy, Length: uint64(len(block)), RelativeOffset: -int64(len(block))})
+		}
+		patch := bench_patch(b, size, actions)
+		b.SetBytes(size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			patch.PatchSourceBytes(nil)
+		}
+	})
+
+	b.Run("alttpr", func(b *testing.B) {
+		sourcedata, err := os.ReadFile("test/Zelda.sfc")
+		if err != nil {
+			b.Skipf("Could not read test/Zelda.sfc.  Skipping this benchmark")
+		}
+		patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+		patch, _ := FromFile(patchfile)
+		b.SetBytes(int64(patch.TargetSize))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			patch.PatchSourceBytes(sourcedata)
+		}
+	})
+}
+
+func TestApplyUnderfilledTarget(t *testing.T) {
+	source := []byte("0123456789")
+	actions, _ := EncodeActions([]Action{{Kind: SourceRead, Length: 6}})
+
+	patch := craft_patch(source, 10, actions)
+	patch.TargetChecksum = crc32.ChecksumIEEE([]byte("012345\x00\x00\x00\x00"))
+
+	_, err := patch.PatchSourceBytes(source)
+	if err == nil || err.Error() != "Patch produced 6 bytes, expected 10" {
+		t.Fatalf("PatchSourceBytes did not report the short output: %v", err)
+	}
+}
+
+func TestApplyContext(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	targetdata, err := patch.ApplyContext(context.Background(), source)
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("ApplyContext did not apply the patch: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = patch.ApplyContext(ctx, source)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ApplyContext did not stop for a canceled context: %v", err)
+	}
+}
+
+func TestChecksumContext(t *testing.T) {
+	data := make([]byte, 3*context_check_bytes+17)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	checksum, err := checksum_context(context.Background(), crc32.NewIEEE(), data)
+	if err != nil || checksum != crc32.ChecksumIEEE(data) {
+		t.Fatalf("checksum_context calculated %08x, %v", checksum, err)
+	}
+}
+
+func TestIncrementalTargetChecksum(t *testing.T) {
+	// A delta patch mixes every action kind, including overlapping
+	// TargetCopy runs, so each must feed the running checksum correctly
+	source, target := synthetic_rom(1 << 16)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+	patch.TargetChecksum ^= 1
+
+	_, err := patch.PatchSourceBytes(source)
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Actual != crc32.ChecksumIEEE(target) {
+		t.Fatalf("Incremental target checksum incorrect: %v", err)
+	}
+}
+
+func FuzzApply(f *testing.F) {
+	for _, path := range []string{"test/testpatch.bps", "test/7f2e1606616492d7dfb589e8dfb70027.bps"} {
+		seed, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatalf("%s", err)
+		}
+		f.Add(seed)
+	}
+	source, _ := os.ReadFile("test/sourceFile")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// The patch checksum would reject nearly every mutation before its
+		// actions are reached, so it is skipped to walk them
+		patch, err := FromBytesOpts(data, ReadOptions{SkipPatchChecksum: true})
+		if err != nil {
+			return
+		}
+
+		// Malformed patches must fail with an error, never a panic.  The
+		// source and target checksums are skipped too so mutated actions are
+		// still applied, and the target capped so the fuzzer isn't slowed by
+		// huge allocations.
+		if patch.TargetSize <= 1<<20 {
+			patch.PatchSourceBytes(source)
+		}
+		patch.ApplyWithOptions(source, ApplyOptions{MaxTargetSize: 1 << 20, SkipSourceChecksum: true, SkipTargetChecksum: true})
+	})
+}
+
+func BenchmarkFromFile(b *testing.B) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	defer patchfile.Close()
+	filestat, _ := patchfile.Stat()
+
+	// Parsing is linear in the patch, not the target, so report throughput
+	// over the patch file
+	b.SetBytes(filestat.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		patchfile.Seek(0, io.SeekStart)
+		if _, err := FromFile(patchfile); err != nil {
+			b.Fatalf("%s", err)
+		}
+	}
+}
+
+func BenchmarkApply(b *testing.B) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	defer patchfile.Close()
+	patch, _ := FromFile(patchfile)
+
+	// Without the real ROM a blank source of the right size exercises exactly
+	// the same actions, only producing a target with the wrong checksum
+	sourcedata, err := os.ReadFile("test/Zelda.sfc")
+	opts := ApplyOptions{}
+	if err != nil {
+		sourcedata = make([]byte, patch.SourceSize)
+		opts.SkipSourceChecksum = true
+	}
+
+	b.SetBytes(int64(patch.TargetSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		patch.ApplyWithOptions(sourcedata, opts)
+	}
+}
+
+func TestApplyInto(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	dst := make([]byte, len(target)+10)
+	for i := 0; i < 2; i++ {
+		written, err := patch.ApplyInto(dst, source)
+		if err != nil || written != len(target) || !bytes.Equal(dst[:written], target) {
+			t.Fatalf("ApplyInto did not write the target into dst: %d, %v", written, err)
+		}
+	}
+
+	// Only the capacity of dst matters
+	written, err := patch.ApplyInto(make([]byte, 0, len(target)), source)
+	if err != nil || written != len(target) {
+		t.Fatalf("ApplyInto did not use the capacity of dst: %d, %v", written, err)
+	}
+}
+
+func TestApplyIntoShortBuffer(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	// A short dst is neither grown nor written to
+	dst := make([]byte, len(target)-1, len(target)-1)
+	written, err := patch.ApplyInto(dst, source)
+	if !errors.Is(err, io.ErrShortBuffer) || written != 0 {
+		t.Fatalf("ApplyInto accepted a short destination: %d, %v", written, err)
+	}
+	if !bytes.Equal(dst, make([]byte, len(dst))) {
+		t.Fatalf("ApplyInto wrote to a short destination")
+	}
+}
+
+func TestApplyCopyOffsetUnderflow(t *testing.T) {
+	source := []byte("0123456789")
+
+	// Move each offset forward first, so an underflow has to overshoot a
+	// non-zero offset rather than just go negative from the start
+	source_underflow, _ := EncodeActions([]Action{
+		{Kind: SourceCopy, Length: 4, RelativeOffset: 3},
+		{Kind: SourceCopy, Length: 2, RelativeOffset: -8},
+	})
+	target_underflow, _ := EncodeActions([]Action{
+		{Kind: TargetRead, Length: 4, Data: []byte("abcd")},
+		{Kind: TargetCopy, Length: 2, RelativeOffset: 2},
+		{Kind: TargetCopy, Length: 2, RelativeOffset: -5},
+	})
+
+	// The largest negative offset the encoding can hold
+	var hostile bytes.Buffer
+	write_action(&hostile, SourceCopy, 1)
+	bps_write_num(&hostile, ^uint64(0))
+
+	cases := map[string]struct {
+		actions []byte
+		err     string
+	}{
+		"source": {source_underflow, "SourceCopy offset underflow at output 4"},
+		"target": {target_underflow, "TargetCopy offset underflow at output 6"},
+		"huge":   {hostile.Bytes(), "SourceCopy offset underflow at output 0"},
+	}
+
+	for name, c := range cases {
+		patch := craft_patch(source, 10, c.actions)
+		_, err := patch.PatchSourceBytes(source)
+		if err == nil || err.Error() != c.err {
+			t.Fatalf("%s: PatchSourceBytes returned %v, expected %q", name, err, c.err)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	original, _ := FromBytes(data)
+
+	clone := original.Clone()
+	if !original.Equal(clone) {
+		t.Fatalf("Clone is not equal to the original")
+	}
+
+	clone.Actions[0] ^= 0xff
+	clone.SetMetadata("changed")
+	if original.Actions[0] == clone.Actions[0] || original.Metadata != "" {
+		t.Fatalf("Changing the clone changed the original")
+	}
+}
+
+func TestApplyConcurrently(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	results := make(chan []byte)
+	for i := 0; i < 8; i++ {
+		go func() {
+			targetdata, _ := patch.PatchSourceBytes(source)
+			results <- targetdata
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if !bytes.Equal(<-results, target) {
+			t.Fatalf("Concurrent apply produced the wrong target")
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	original, _ := FromBytes(data)
+
+	if !original.Equal(original.Clone()) {
+		t.Fatalf("Equal rejected an identical patch")
+	}
+
+	changed := original.Clone()
+	changed.Actions[len(changed.Actions)-1] ^= 0x01
+	if original.Equal(changed) {
+		t.Fatalf("Equal ignored a changed action stream")
+	}
+
+	changed = original.Clone()
+	changed.TargetChecksum ^= 0x01
+	if original.Equal(changed) {
+		t.Fatalf("Equal ignored a changed checksum")
+	}
+
+	var nil_patch *BPSPatch
+	if !nil_patch.Equal(nil) || nil_patch.Equal(&original) || original.Equal(nil) {
+		t.Fatalf("Equal is not nil safe")
+	}
+}
+
+func TestAppendNum(t *testing.T) {
+	for _, num := range []uint64{0, 1, 127, 128, 129, 0xdeadbeef, 0xdeadbeefdeadbeef, ^uint64(0)} {
+		var written bytes.Buffer
+		bps_write_num(&written, num)
+
+		appended := AppendNum([]byte("prefix"), num)
+		if string(appended[:6]) != "prefix" || !bytes.Equal(appended[6:], written.Bytes()) {
+			t.Fatalf("AppendNum(%x) = % x, WriteNum wrote % x", num, appended[6:], written.Bytes())
+		}
+
+		decoded, _, err := bps_read_num(appended[6:])
+		if err != nil || decoded != num {
+			t.Fatalf("AppendNum(%x) decoded as %x: %v", num, decoded, err)
+		}
+	}
+
+	// The +1 carry makes 129 two bytes, 0x01 0x80, as TestReadNumUnambiguous
+	// expects
+	if !bytes.Equal(AppendNum(nil, 129), []byte{0x01, 0x80}) {
+		t.Fatalf("AppendNum(129) = % x", AppendNum(nil, 129))
+	}
+}
+
+func TestVarintLen(t *testing.T) {
+	cases := map[uint64]int{
+		0:                  1,
+		127:                1,
+		128:                2,
+		16511:              2,
+		16512:              3,
+		0xdeadbeef:         5,
+		0xdeadbeefdeadbeef: 10,
+		^uint64(0):         10,
+	}
+
+	for num, expected := range cases {
+		if VarintLen(num) != expected || len(AppendNum(nil, num)) != expected {
+			t.Fatalf("VarintLen(%x) = %d, AppendNum wrote %d bytes, expected %d", num, VarintLen(num), len(AppendNum(nil, num)), expected)
+		}
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		num := random.Uint64() >> random.Intn(64)
+		if VarintLen(num) != len(AppendNum(nil, num)) {
+			t.Fatalf("VarintLen(%x) = %d, AppendNum wrote %d bytes", num, VarintLen(num), len(AppendNum(nil, num)))
+		}
+	}
+}
+
+func TestReadNumTooLong(t *testing.T) {
+	_, _, _, err := ReadNum(bytes.Repeat([]byte{0x00}, 11))
+	if err == nil || err.Error() != "bps_read_num: varint too long" {
+		t.Fatalf("ReadNum of 11 continuation bytes returned %v", err)
+	}
+
+	// Ten bytes hold any uint64, but the last can still push it past 64 bits
+	overflow := append(bytes.Repeat([]byte{0x7f}, 9), 0xff)
+	_, _, _, err = ReadNum(overflow)
+	if err == nil || err.Error() != "bps_read_num: varint overflows 64 bits" {
+		t.Fatalf("ReadNum of an overflowing varint returned %v", err)
+	}
+
+	value, _, _, err := ReadNum(AppendNum(nil, ^uint64(0)))
+	if err != nil || value != ^uint64(0) {
+		t.Fatalf("ReadNum of the largest uint64 returned %x, %v", value, err)
+	}
+}
+
+func TestApplyFromScratch(t *testing.T) {
+	// A patch which builds its target from nothing, as when a whole ROM is
+	// bundled as a patch
+	var builder PatchBuilder
+	builder.AddTargetRead([]byte("from scratch "))
+	builder.AddTargetCopy(0, 13)
+	builder.AddTargetCopy(12, 8)
+	patch, err := builder.Build(nil, "")
+	if err != nil {
+		t.Fatalf("Build returned an error: %s", err)
+	}
+
+	if patch.SourceSize != 0 || patch.SourceChecksum != 0 {
+		t.Fatalf("An empty source has size %d and checksum %08x", patch.SourceSize, patch.SourceChecksum)
+	}
+
+	expected := []byte("from scratch from scratch " + strings.Repeat(" ", 8))
+	targetdata, err := patch.PatchSourceBytes(nil)
+	if err != nil || !bytes.Equal(targetdata, expected) {
+		t.Fatalf("PatchSourceBytes(nil) produced %q: %v", targetdata, err)
+	}
+
+	if !bytes.Equal(apply_via_file(patch, nil, t), expected) {
+		t.Fatalf("PatchSourceFile of an empty file did not produce the target")
+	}
+
+	targetdata, err = patch.ApplyReaderAt(bytes.NewReader(nil))
+	if err != nil || !bytes.Equal(targetdata, expected) {
+		t.Fatalf("ApplyReaderAt of an empty source produced %q: %v", targetdata, err)
+	}
+}
+
+func TestApplyEmptyTarget(t *testing.T) {
+	source := []byte("everything goes")
+	created, _ := CreatePatch(source, nil, "")
+
+	serialized, _ := created.MarshalBinary()
+	patch, err := FromBytes(serialized)
+	if err != nil {
+		t.Fatalf("FromBytes of an empty target patch returned an error: %s", err)
+	}
+
+	if patch.TargetSize != 0 || patch.TargetChecksum != 0 || len(patch.Actions) != 0 {
+		t.Fatalf("Empty target patch has size %d, checksum %08x and %d action bytes", patch.TargetSize, patch.TargetChecksum, len(patch.Actions))
+	}
+
+	if err := patch.Validate(); err != nil {
+		t.Fatalf("Validate rejected an empty target patch: %s", err)
+	}
+
+	targetdata, err := patch.PatchSourceBytes(source)
+	if err != nil || targetdata == nil || len(targetdata) != 0 {
+		t.Fatalf("PatchSourceBytes of an empty target patch returned %q: %v", targetdata, err)
+	}
+
+	if targetdata := apply_via_file(&patch, source, t); len(targetdata) != 0 {
+		t.Fatalf("PatchSourceFile of an empty target patch returned %q", targetdata)
+	}
+}
+
+func TestFormatConstants(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	if !strings.HasPrefix(string(data), Magic) {
+		t.Fatalf("Fixture does not start with %q", Magic)
+	}
+
+	// The footer is the source, target and patch checksums
+	patch, _ := FromBytes(data)
+	footer, _ := (&BPSPatch{SourceChecksum: patch.SourceChecksum, TargetChecksum: patch.TargetChecksum}).MarshalBinary()
+	footer = footer[len(footer)-FooterSize : len(footer)-4]
+	if !bytes.Equal(footer, data[len(data)-FooterSize:len(data)-4]) {
+		t.Fatalf("Footer of %d bytes does not hold the source and target checksums", FooterSize)
+	}
+}
+
+func TestApplyRange(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	for _, r := range [][2]uint64{{0, 0}, {0, 16}, {100, 2000}, {uint64(len(target)) - 10, uint64(len(target))}, {0, uint64(len(target))}} {
+		part, err := patch.ApplyRange(source, r[0], r[1])
+		if err != nil {
+			t.Fatalf("ApplyRange(%d, %d) returned an error: %s", r[0], r[1], err)
+		}
+		if !bytes.Equal(part, target[r[0]:r[1]]) {
+			t.Fatalf("ApplyRange(%d, %d) returned the wrong bytes", r[0], r[1])
+		}
+	}
+
+	if _, err := patch.ApplyRange(source, 10, 5); err == nil {
+		t.Fatalf("ApplyRange accepted a backwards range")
+	}
+	if _, err := patch.ApplyRange(source, 0, uint64(len(target))+1); err == nil {
+		t.Fatalf("ApplyRange accepted a range past the end of the target")
+	}
+	if _, err := patch.ApplyRange(target, 0, 16); err == nil {
+		t.Fatalf("ApplyRange accepted the wrong source")
+	}
+}
+
+func TestApplyRangeShortActions(t *testing.T) {
+	source := []byte("01234567")
+	var encoded bytes.Buffer
+	write_action(&encoded, SourceRead, 4)
+	patch := craft_patch(source, 8, encoded.Bytes())
+
+	if part, err := patch.ApplyRange(source, 0, 4); err != nil || string(part) != "0123" {
+		t.Fatalf("ApplyRange of the produced bytes returned %q, %v", part, err)
+	}
+	if _, err := patch.ApplyRange(source, 2, 6); err == nil {
+		t.Fatalf("ApplyRange accepted a range the actions do not produce")
+	}
+}
+
+func TestApplyTargetReadsOnly(t *testing.T) {
+	expected := []byte("embedded in full")
+	actions, _ := EncodeActions([]Action{
+		{Kind: TargetRead, Length: 9, Data: expected[:9]},
+		{Kind: TargetRead, Length: 7, Data: expected[9:]},
+	})
+	patch := craft_patch(nil, uint64(len(expected)), actions)
+	patch.TargetChecksum = crc32.ChecksumIEEE(expected)
+
+	if patch.target_read_payloads() == nil {
+		t.Fatalf("Patch of only TargetReads was not recognized")
+	}
+
+	targetdata, err := patch.PatchSourceBytes(nil)
+	if err != nil {
+		t.Fatalf("PatchSourceBytes returned an error: %s", err)
+	}
+	if !bytes.Equal(targetdata, expected) {
+		t.Fatalf("TargetReads produced %q, expected %q", targetdata, expected)
+	}
+
+	// The fast path fails a bad checksum just as the action loop does
+	patch.TargetChecksum ^= 1
+	targetdata, err = patch.PatchSourceBytes(nil)
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumTarget || !bytes.Equal(targetdata, expected) {
+		t.Fatalf("Bad target checksum returned %v, expected a target checksum error", err)
+	}
+}
+
+func TestApplyTargetReadsOnlyFallsBack(t *testing.T) {
+	short, _ := EncodeActions([]Action{{Kind: TargetRead, Length: 4, Data: []byte("abcd")}})
+	with_copy, _ := EncodeActions([]Action{
+		{Kind: TargetRead, Length: 4, Data: []byte("abcd")},
+		{Kind: TargetCopy, Length: 4, RelativeOffset: 0},
+	})
+
+	for name, patch := range map[string]*BPSPatch{
+		"short":       craft_patch(nil, 8, short),
+		"target copy": craft_patch(nil, 8, with_copy),
+		"source":      craft_patch([]byte("abcd"), 4, short),
+		"truncated":   craft_patch(nil, 4, short[:3]),
+	} {
+		if patch.target_read_payloads() != nil {
+			t.Fatalf("%s: Patch was taken for only TargetReads", name)
+		}
+	}
+
+	if _, err := craft_patch(nil, 8, short).PatchSourceBytes(nil); err == nil {
+		t.Fatalf("TargetReads short of the target applied")
+	}
+}
+
+func BenchmarkTargetReadOnly(b *testing.B) {
+	const size = 1 << 20
+
+	// A from scratch patch, embedding the whole target
+	block := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(block)
+	patch := bench_patch(b, size, []Action{{Kind: TargetRead, Length: size, Data: block}})
+
+	b.Run("fast path", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			patch.PatchSourceBytes(nil)
+		}
+	})
+
+	b.Run("action loop", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			patch.apply(context.Background(), bytes.NewReader(nil), &slice_actions{data: patch.Actions}, nil, ApplyOptions{})
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package bps
+
+import (
+	"hash/crc32"
+)
+
+// Builds a patch from an explicit list of actions, for tools which already
+// know exactly what edits they want to make.  Actions are only checked when
+// Build is called.
+type PatchBuilder struct {
+	actions     []Action
+	target_size uint64
+}
+
+// Copy length bytes from the source at the current output offset
+func (builder *PatchBuilder) AddSourceRead(length uint64) {
+	builder.add(Action{Kind: SourceRead, Length: length})
+}
+
+// Write data, which is stored verbatim in the patch
+func (builder *PatchBuilder) AddTargetRead(data []byte) {
+	builder.add(Action{Kind: TargetRead, Length: uint64(len(data)), Data: append([]byte(nil), data...)})
+}
+
+// Copy length bytes from elsewhere in the source.  relOffset moves the source
+// offset, which starts at zero and is left just past the last byte copied.
+func (builder *PatchBuilder) AddSourceCopy(relOffset int64, length uint64) {
+	builder.add(Action{Kind: SourceCopy, Length: length, RelativeOffset: relOffset})
+}
+
+// Copy length bytes from earlier in the target.  relOffset moves the target
+// offset, which starts at zero and is left just past the last byte copied.
+func (builder *PatchBuilder) AddTargetCopy(relOffset int64, length uint64) {
+	builder.add(Action{Kind: TargetCopy, Length: length, RelativeOffset: relOffset})
+}
+
+func (builder *PatchBuilder) add(action Action) {
+	builder.actions = append(builder.actions, action)
+	builder.target_size += action.Length
+}
+
+// Encode the accumulated actions into a patch against source.  The actions
+// are applied to source to derive the target, so every size and checksum in
+// the returned patch is filled in and the patch is known to apply cleanly.
+func (builder *PatchBuilder) Build(source []byte, metadata string) (*BPSPatch, error) {
+	actions, err := EncodeActions(builder.actions)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := &BPSPatch{
+		SourceSize:     uint64(len(source)),
+		TargetSize:     builder.target_size,
+		MetadataSize:   uint64(len(metadata)),
+		Metadata:       metadata,
+		Actions:        actions,
+		SourceChecksum: crc32.ChecksumIEEE(source),
+	}
+
+	target, err := patch.ApplyWithOptions(source, ApplyOptions{SkipTargetChecksum: true})
+	if err != nil {
+		return nil, err
+	}
+	patch.TargetChecksum = crc32.ChecksumIEEE(target)
+
+	// Serializing fills in the PatchChecksum
+	_, err = patch.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return patch, nil
+}
@@ -0,0 +1,64 @@
+package bps
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPatchBuilder(t *testing.T) {
+	source := []byte("hello world")
+
+	var builder PatchBuilder
+	builder.AddSourceRead(6)
+	builder.AddTargetRead([]byte("there "))
+	builder.AddSourceCopy(0, 5)
+	builder.AddTargetCopy(6, 5)
+	builder.AddTargetCopy(10, 3)
+
+	patch, err := builder.Build(source, "built")
+	if err != nil {
+		t.Fatalf("Build returned an error: %s", err)
+	}
+
+	if patch.Metadata != "built" || patch.SourceSize != uint64(len(source)) {
+		t.Fatalf("Build header incorrect: %+v", patch)
+	}
+
+	serialized, _ := patch.MarshalBinary()
+	reparsed, err := FromBytes(serialized)
+	if err != nil {
+		t.Fatalf("Built patch did not parse: %s", err)
+	}
+
+	target, err := reparsed.PatchSourceBytes(source)
+	if err != nil {
+		t.Fatalf("Built patch did not apply: %s", err)
+	}
+	if !bytes.Equal(target, []byte("hello there hellothereeee")) {
+		t.Fatalf("Built patch produced %q", target)
+	}
+}
+
+func TestPatchBuilderInvalid(t *testing.T) {
+	var builder PatchBuilder
+	builder.AddSourceCopy(2, 4)
+
+	if _, err := builder.Build([]byte("abc"), ""); err == nil {
+		t.Fatalf("Build accepted a SourceCopy past the end of the source")
+	}
+
+	builder = PatchBuilder{}
+	builder.AddSourceRead(0)
+
+	if _, err := builder.Build([]byte("abc"), ""); err == nil {
+		t.Fatalf("Build accepted a zero length action")
+	}
+}
+
+func TestPatchBuilderLengthOverflow(t *testing.T) {
+	var builder PatchBuilder
+	builder.AddSourceRead(1<<62 + 1)
+	if _, err := builder.Build(nil, ""); err == nil {
+		t.Fatalf("Build accepted an action too long for its header")
+	}
+}
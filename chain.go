@@ -0,0 +1,71 @@
+package bps
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A sequence of patches applied one after another, such as a base patch
+// followed by a randomizer patch.  Each patch is applied to the output of the
+// one before it.  PatchChain satisfies Patcher.
+type PatchChain struct {
+	patches []*BPSPatch
+}
+
+// Append a patch to the end of the chain
+func (chain *PatchChain) Add(patch *BPSPatch) {
+	chain.patches = append(chain.patches, patch)
+}
+
+// Apply every patch in the chain in order, starting from source, and return
+// the output of the last.  Every stage's checksums are verified.  A source
+// size or checksum mismatch part way along usually means the patches were
+// added out of order, or do not belong together, so the error names the
+// stage.
+func (chain *PatchChain) Apply(source []byte) ([]byte, error) {
+	data := source
+
+	for i, patch := range chain.patches {
+		target_data, err := patch.PatchSourceBytes(data)
+		if err != nil {
+			// A SourceSizeError is found as a source ChecksumError too
+			var checksum_err *ChecksumError
+			if errors.As(err, &checksum_err) && checksum_err.Kind == ChecksumSource && i > 0 {
+				return nil, fmt.Errorf("Stage %d of %d does not apply to the output of stage %d: %w", i+1, len(chain.patches), i, err)
+			}
+			return nil, fmt.Errorf("Stage %d of %d: %w", i+1, len(chain.patches), err)
+		}
+		data = target_data
+	}
+
+	return data, nil
+}
+
+// Combine patch a, turning source into some intermediate file, and patch b,
+// turning that intermediate file into the final target, into one patch turning
+// source straight into the target.  Both patches are applied to build the
+// target, then a fresh patch is created from source to target.  When both
+// patches carry different metadata the merged patch has both, a's first,
+// separated by a newline.
+func MergePatches(a, b *BPSPatch, source []byte) (*BPSPatch, error) {
+	if a.TargetChecksum != b.SourceChecksum || a.TargetSize != b.SourceSize {
+		return nil, fmt.Errorf("Patches do not chain: first produces %d bytes with checksum %08x, second expects %d bytes with checksum %08x",
+			a.TargetSize, a.TargetChecksum, b.SourceSize, b.SourceChecksum)
+	}
+
+	chain := PatchChain{patches: []*BPSPatch{a, b}}
+	target, err := chain.Apply(source)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := a.Metadata
+	switch {
+	case metadata == "":
+		metadata = b.Metadata
+	case b.Metadata != "" && b.Metadata != metadata:
+		metadata += "\n" + b.Metadata
+	}
+
+	return CreatePatchDelta(source, target, EncodeOptions{Metadata: metadata})
+}
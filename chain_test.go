@@ -0,0 +1,83 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func chain_fixture() (source, mid, target []byte, first, second *BPSPatch) {
+	source, mid = synthetic_rom(1 << 12)
+	target = append([]byte("SECOND STAGE"), mid...)
+
+	first, _ = CreatePatchDelta(source, mid, EncodeOptions{})
+	second, _ = CreatePatchDelta(mid, target, EncodeOptions{})
+	return
+}
+
+func TestPatchChain(t *testing.T) {
+	source, _, target, first, second := chain_fixture()
+
+	var chain PatchChain
+	chain.Add(first)
+	chain.Add(second)
+
+	targetdata, err := chain.Apply(source)
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("PatchChain did not apply both stages: %v", err)
+	}
+
+	var empty PatchChain
+	if targetdata, err := empty.Apply(source); err != nil || !bytes.Equal(targetdata, source) {
+		t.Fatalf("An empty PatchChain changed the source: %v", err)
+	}
+}
+
+func TestPatchChainOutOfOrder(t *testing.T) {
+	_, mid, _, first, second := chain_fixture()
+
+	var chain PatchChain
+	chain.Add(second)
+	chain.Add(first)
+
+	// The second patch applies cleanly to mid, but the first then sees the
+	// wrong source
+	_, err := chain.Apply(mid)
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || !strings.HasPrefix(err.Error(), "Stage 2 of 2 does not apply to the output of stage 1") {
+		t.Fatalf("PatchChain did not name the mismatched stage: %v", err)
+	}
+	var size_err *SourceSizeError
+	if !errors.As(err, &size_err) {
+		t.Fatalf("PatchChain did not report the source size: %v", err)
+	}
+}
+
+func TestMergePatches(t *testing.T) {
+	source, _, target, first, second := chain_fixture()
+	first.SetMetadata("base")
+	second.SetMetadata("randomizer")
+
+	merged, err := MergePatches(first, second, source)
+	if err != nil {
+		t.Fatalf("MergePatches returned an error: %s", err)
+	}
+
+	if merged.Metadata != "base\nrandomizer" {
+		t.Fatalf("MergePatches metadata incorrect: %q", merged.Metadata)
+	}
+
+	targetdata, err := merged.PatchSourceBytes(source)
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("Merged patch did not reproduce the target: %v", err)
+	}
+}
+
+func TestMergePatchesMismatched(t *testing.T) {
+	source, _, _, first, second := chain_fixture()
+
+	if _, err := MergePatches(second, first, source); err == nil || !strings.HasPrefix(err.Error(), "Patches do not chain") {
+		t.Fatalf("MergePatches accepted patches which do not chain: %v", err)
+	}
+}
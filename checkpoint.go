@@ -0,0 +1,151 @@
+package bps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Marks the start of a serialized Checkpoint
+const checkpoint_magic = "BPSC"
+
+// How far ApplyToStorage or ResumeApply had got through a patch, for carrying
+// on with ResumeApply after an interruption.  A checkpoint records where the
+// next action starts and the checksum of the target produced before it, but
+// not the target itself, which the caller must keep in storage.  Save it with
+// MarshalBinary and load it back with UnmarshalBinary.
+type Checkpoint struct {
+	patch_checksum uint32
+	// Where in the patch's Actions the next action starts
+	action_offset uint64
+	state         walk_state
+	// The checksum of the first state.output_offset bytes of the target,
+	// when the target checksum is being verified
+	target_checksum     uint32
+	has_target_checksum bool
+}
+
+// Number of target bytes produced before the checkpoint, which must still be
+// in storage to resume from it
+func (checkpoint Checkpoint) TargetOffset() uint64 {
+	return checkpoint.state.output_offset
+}
+
+// Encode the checkpoint for saving alongside the partial target
+func (checkpoint Checkpoint) MarshalBinary() ([]byte, error) {
+	data := []byte(checkpoint_magic)
+	data = AppendNum(data, checkpoint.action_offset)
+	data = AppendNum(data, checkpoint.state.output_offset)
+	data = AppendNum(data, checkpoint.state.source_offset)
+	data = AppendNum(data, checkpoint.state.target_offset)
+	data = binary.LittleEndian.AppendUint32(data, checkpoint.patch_checksum)
+	data = binary.LittleEndian.AppendUint32(data, checkpoint.target_checksum)
+	if checkpoint.has_target_checksum {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	return data, nil
+}
+
+// Decode a checkpoint encoded by MarshalBinary
+func (checkpoint *Checkpoint) UnmarshalBinary(data []byte) error {
+	if len(data) < len(checkpoint_magic) || string(data[:len(checkpoint_magic)]) != checkpoint_magic {
+		return errors.New("Not a BPS checkpoint")
+	}
+	data = data[len(checkpoint_magic):]
+
+	var decoded Checkpoint
+	for _, num := range []*uint64{&decoded.action_offset, &decoded.state.output_offset, &decoded.state.source_offset, &decoded.state.target_offset} {
+		var err error
+		*num, data, _, err = ReadNum(data)
+		if err != nil {
+			return fmt.Errorf("Error reading checkpoint: %w", err)
+		}
+	}
+
+	if len(data) != 9 || data[8] > 1 {
+		return errors.New("Checkpoint truncated or corrupt")
+	}
+	decoded.patch_checksum = binary.LittleEndian.Uint32(data[0:4])
+	decoded.target_checksum = binary.LittleEndian.Uint32(data[4:8])
+	decoded.has_target_checksum = data[8] == 1
+
+	*checkpoint = decoded
+	return nil
+}
+
+// Take a checkpoint after an action, with the walk at state, everything before
+// it flushed to target and the rest of the patch left in actions
+func (patch *BPSPatch) checkpoint(state walk_state, target *window_target, actions *slice_actions) Checkpoint {
+	checkpoint := Checkpoint{
+		patch_checksum: patch.PatchChecksum,
+		action_offset:  uint64(len(patch.Actions)) - actions.remaining(),
+		state:          state,
+	}
+	if target.checksum != nil {
+		checkpoint.target_checksum = target.checksum.Sum32()
+		checkpoint.has_target_checksum = true
+	}
+	return checkpoint
+}
+
+// Carry on applying the patch from a checkpoint passed to OnCheckpoint by an
+// earlier ApplyToStorage or ResumeApply, which was interrupted.
+// partial_target must hold the target that run produced, at least up to the
+// checkpoint's TargetOffset; the rest of the target is written after it.
+//
+// opts is honored as ApplyToStorage honors it, so further checkpoints can be
+// taken.  Unless opts skips them the source is verified again, as is the
+// partial target against the checksum in the checkpoint, and the target
+// checksum is verified over the whole target once the resumed run completes.
+func (patch *BPSPatch) ResumeApply(checkpoint Checkpoint, source io.ReaderAt, partial_target TargetStorage, opts ApplyOptions) (err error) {
+	defer func() { opts.log_apply(patch, err) }()
+
+	err = opts.check_sizes(patch)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint.patch_checksum != patch.PatchChecksum {
+		return fmt.Errorf("Checkpoint is for a patch with checksum %08x, not %08x", checkpoint.patch_checksum, patch.PatchChecksum)
+	}
+	state := checkpoint.state
+	if checkpoint.action_offset > uint64(len(patch.Actions)) || state.output_offset > patch.TargetSize ||
+		state.source_offset > patch.SourceSize || state.target_offset > state.output_offset {
+		return errors.New("Checkpoint does not fit the patch")
+	}
+
+	if !opts.SkipSourceChecksum {
+		err = patch.verify_source_with(io.NewSectionReader(source, 0, int64(patch.SourceSize)), opts.new_hash())
+		if err != nil {
+			return err
+		}
+	}
+
+	target := &window_target{storage: partial_target, flushed: state.output_offset, pending: make([]byte, 0, storage_window_size)}
+	if !opts.SkipTargetChecksum {
+		if !checkpoint.has_target_checksum {
+			return errors.New("Checkpoint was taken without a target checksum, so the target cannot be verified")
+		}
+
+		// The target checksum is calculated in order, so picks up from the
+		// partial target
+		target.checksum = opts.new_hash()
+		var partial_read int64
+		partial_read, err = io.CopyBuffer(target.checksum, io.NewSectionReader(partial_target, 0, int64(state.output_offset)), make([]byte, crc_chunk_size))
+		if err != nil {
+			return fmt.Errorf("Partial target read: %w", err)
+		}
+		if uint64(partial_read) != state.output_offset {
+			return fmt.Errorf("Partial target is %d bytes, checkpoint needs %d", partial_read, state.output_offset)
+		}
+		if calculated := target.checksum.Sum32(); calculated != checkpoint.target_checksum {
+			return fmt.Errorf("Partial target checksum %08x does not match the checkpoint, expected %08x", calculated, checkpoint.target_checksum)
+		}
+	}
+
+	actions := &slice_actions{data: patch.Actions[checkpoint.action_offset:]}
+	return patch.apply_to_storage(source, target, actions, state, opts)
+}
@@ -0,0 +1,141 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// A patch producing several windows of target, from copies of both the source
+// and the target
+func checkpoint_patch(t *testing.T) (patch *BPSPatch, source, target []byte) {
+	source = []byte("0123456789")
+	var encoded bytes.Buffer
+	write_action(&encoded, TargetRead, 4)
+	encoded.WriteString("abcd")
+	for i := 0; i < 3; i++ {
+		write_action(&encoded, TargetCopy, storage_window_size)
+		write_relative_offset(&encoded, 1)
+		write_action(&encoded, SourceCopy, 10)
+		if i == 0 {
+			write_relative_offset(&encoded, 0)
+		} else {
+			write_relative_offset(&encoded, -10)
+		}
+	}
+
+	patch = craft_patch(source, 4+3*(storage_window_size+10), encoded.Bytes())
+	target, err := patch.ApplyWithOptions(source, ApplyOptions{SkipTargetChecksum: true})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions returned an error: %s", err)
+	}
+	patch.TargetChecksum = crc32.ChecksumIEEE(target)
+	return patch, source, target
+}
+
+// Apply patch to storage, stopping at the first checkpoint, and return the
+// checkpoint as saved
+func interrupted_apply(t *testing.T, patch *BPSPatch, source []byte, storage *memory_storage) []byte {
+	interrupted := errors.New("Interrupted")
+	var saved []byte
+	err := patch.ApplyToStorage(bytes.NewReader(source), storage, ApplyOptions{
+		OnCheckpoint: func(checkpoint Checkpoint) error {
+			saved, _ = checkpoint.MarshalBinary()
+			return interrupted
+		},
+	})
+	if err != interrupted {
+		t.Fatalf("ApplyToStorage returned %v, expected the OnCheckpoint error", err)
+	}
+	return saved
+}
+
+func TestResumeApply(t *testing.T) {
+	patch, source, expected := checkpoint_patch(t)
+
+	var storage memory_storage
+	saved := interrupted_apply(t, patch, source, &storage)
+
+	var checkpoint Checkpoint
+	err := checkpoint.UnmarshalBinary(saved)
+	if err != nil {
+		t.Fatalf("UnmarshalBinary returned an error: %s", err)
+	}
+	if checkpoint.TargetOffset() == 0 || checkpoint.TargetOffset() >= patch.TargetSize {
+		t.Fatalf("Checkpoint taken at %d of %d target bytes", checkpoint.TargetOffset(), patch.TargetSize)
+	}
+
+	// Only what the checkpoint covers needs to have survived
+	storage.data = storage.data[:checkpoint.TargetOffset()]
+
+	checkpoints := 0
+	err = patch.ResumeApply(checkpoint, bytes.NewReader(source), &storage, ApplyOptions{
+		OnCheckpoint: func(Checkpoint) error {
+			checkpoints++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("ResumeApply returned an error: %s", err)
+	}
+	if !bytes.Equal(storage.data, expected) {
+		t.Fatalf("ResumeApply produced the wrong target")
+	}
+	if checkpoints == 0 {
+		t.Fatalf("ResumeApply took no further checkpoints")
+	}
+}
+
+func TestResumeApplyCorruptTarget(t *testing.T) {
+	patch, source, _ := checkpoint_patch(t)
+
+	var storage memory_storage
+	var checkpoint Checkpoint
+	checkpoint.UnmarshalBinary(interrupted_apply(t, patch, source, &storage))
+
+	storage.data[0] ^= 0x01
+	err := patch.ResumeApply(checkpoint, bytes.NewReader(source), &storage, ApplyOptions{})
+	if err == nil {
+		t.Fatalf("ResumeApply accepted a corrupt partial target")
+	}
+
+	storage.data = storage.data[:checkpoint.TargetOffset()-1]
+	err = patch.ResumeApply(checkpoint, bytes.NewReader(source), &storage, ApplyOptions{})
+	if err == nil {
+		t.Fatalf("ResumeApply accepted a short partial target")
+	}
+}
+
+func TestResumeApplyWrongPatch(t *testing.T) {
+	patch, source, _ := checkpoint_patch(t)
+
+	var storage memory_storage
+	var checkpoint Checkpoint
+	checkpoint.UnmarshalBinary(interrupted_apply(t, patch, source, &storage))
+
+	other := patch.Clone()
+	other.PatchChecksum ^= 1
+	err := other.ResumeApply(checkpoint, bytes.NewReader(source), &storage, ApplyOptions{})
+	if err == nil {
+		t.Fatalf("ResumeApply accepted a checkpoint from another patch")
+	}
+}
+
+func TestCheckpointUnmarshalInvalid(t *testing.T) {
+	patch, source, _ := checkpoint_patch(t)
+	var storage memory_storage
+	saved := interrupted_apply(t, patch, source, &storage)
+
+	var checkpoint Checkpoint
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"no magic":  append([]byte("BPS1"), saved[4:]...),
+		"truncated": saved[:len(saved)-1],
+		"trailing":  append(append([]byte(nil), saved...), 0),
+	} {
+		if err := checkpoint.UnmarshalBinary(data); err == nil {
+			t.Fatalf("%s: UnmarshalBinary did not return an error", name)
+		}
+	}
+}
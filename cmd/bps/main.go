@@ -0,0 +1,226 @@
+// Command bps applies, creates, inspects and verifies BPS patches from the
+// command line.
+//
+// Usage:
+//
+//	bps apply <patch.bps> <source> <output>
+//	bps create [-metadata string] <source> <target> <output.bps>
+//	bps info [-json] <patch.bps>
+//	bps verify [-apply] <patch.bps> [source]
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mgius/bps"
+)
+
+const usage = `Usage:
+  bps apply <patch.bps> <source> <output>
+  bps create [-metadata string] <source> <target> <output.bps>
+  bps info [-json] <patch.bps>
+  bps verify [-apply] <patch.bps> [source]
+`
+
+// Action names for bps info, indexed by action number
+var action_names = [...]string{
+	bps.SourceRead: "SourceRead",
+	bps.TargetRead: "TargetRead",
+	bps.SourceCopy: "SourceCopy",
+	bps.TargetCopy: "TargetCopy",
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Run the command described by args, returning the process exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "apply":
+		if len(args) != 4 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		err = bps.ApplyFile(args[1], args[2], args[3])
+	case "create":
+		flags := flag.NewFlagSet("create", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		metadata := flags.String("metadata", "", "metadata string to store in the patch")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 3 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		err = create(flags.Arg(0), flags.Arg(1), flags.Arg(2), *metadata)
+	case "info":
+		flags := flag.NewFlagSet("info", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		as_json := flags.Bool("json", false, "print machine readable JSON")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 1 {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		err = info(stdout, flags.Arg(0), *as_json)
+	case "verify":
+		flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		full_apply := flags.Bool("apply", false, "apply the patch to check the target checksum")
+		if flags.Parse(args[1:]) != nil || flags.NArg() < 1 || flags.NArg() > 2 || (*full_apply && flags.NArg() != 2) {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		err = verify(stdout, flags.Arg(0), flags.Arg(1), *full_apply)
+	default:
+		fmt.Fprintf(stderr, "Unknown command %q\n%s", args[0], usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "bps %s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// Create a patch turning the source file into the target file and write it to
+// output_path.  CreatePatchDelta applies the patch back to the source first,
+// so a patch which fails to reproduce the target is never written.
+func create(source_path, target_path, output_path, metadata string) error {
+	source, err := os.ReadFile(source_path)
+	if err != nil {
+		return err
+	}
+	target, err := os.ReadFile(target_path)
+	if err != nil {
+		return err
+	}
+
+	patch, err := bps.CreatePatchDelta(source, target, bps.EncodeOptions{Metadata: metadata})
+	if err != nil {
+		return err
+	}
+
+	return patch.WriteToFile(output_path)
+}
+
+// The JSON output of bps info
+type info_json struct {
+	Patch   *bps.BPSPatch          `json:"patch"`
+	Actions int                    `json:"actions"`
+	Stats   map[string]action_json `json:"stats"`
+}
+
+type action_json struct {
+	Count int    `json:"count"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// Print the header and action statistics of the patch at patch_path
+func info(stdout io.Writer, patch_path string, as_json bool) error {
+	patchfile, err := os.Open(patch_path)
+	if err != nil {
+		return err
+	}
+	defer patchfile.Close()
+
+	patch, err := bps.FromFile(patchfile)
+	if err != nil {
+		return fmt.Errorf("Reading patch %s: %w", patch_path, err)
+	}
+
+	stats, err := patch.Stats()
+	if err != nil {
+		return err
+	}
+
+	if as_json {
+		output := info_json{Patch: &patch, Actions: stats.Actions, Stats: map[string]action_json{}}
+		for kind, name := range action_names {
+			output.Stats[name] = action_json{Count: stats.Count[kind], Bytes: stats.Bytes[kind]}
+		}
+
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+
+	fmt.Fprintf(stdout, "Source size:     %d\n", patch.SourceSize)
+	fmt.Fprintf(stdout, "Target size:     %d\n", patch.TargetSize)
+	fmt.Fprintf(stdout, "Metadata size:   %d\n", patch.MetadataSize)
+	fmt.Fprintf(stdout, "Source checksum: %08x\n", patch.SourceChecksum)
+	fmt.Fprintf(stdout, "Target checksum: %08x\n", patch.TargetChecksum)
+	fmt.Fprintf(stdout, "Patch checksum:  %08x\n", patch.PatchChecksum)
+	fmt.Fprintf(stdout, "Metadata:        %q\n", patch.Metadata)
+	fmt.Fprintf(stdout, "Actions:         %d\n", stats.Actions)
+	for kind, name := range action_names {
+		fmt.Fprintf(stdout, "  %-10s  %8d actions  %10d bytes\n", name, stats.Count[kind], stats.Bytes[kind])
+	}
+
+	return nil
+}
+
+// Check everything about the patch at patch_path that can be checked: its own
+// checksum, and given a source, the source checksum and optionally the target
+// checksum after a full apply.  Each result is printed, and an error returned
+// if any check failed.
+func verify(stdout io.Writer, patch_path, source_path string, full_apply bool) error {
+	data, err := os.ReadFile(patch_path)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	report := func(check string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(stdout, "%-16s FAILED: %s\n", check, err)
+		} else {
+			fmt.Fprintf(stdout, "%-16s ok\n", check)
+		}
+	}
+
+	report("Patch checksum", bps.VerifyPatchChecksum(data))
+
+	// The patch checksum has been reported already, so parse regardless to
+	// report on the source and target too
+	patch, err := bps.FromBytesOpts(data, bps.ReadOptions{SkipPatchChecksum: true})
+	if err != nil {
+		return fmt.Errorf("Reading patch %s: %w", patch_path, err)
+	}
+
+	if source_path != "" {
+		sourcefile, err := os.Open(source_path)
+		if err != nil {
+			return err
+		}
+		defer sourcefile.Close()
+
+		err = patch.VerifySource(sourcefile)
+		report("Source checksum", err)
+
+		if full_apply && err == nil {
+			_, err = sourcefile.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			_, err = patch.PatchSourceFile(sourcefile)
+			report("Target checksum", err)
+		}
+	}
+
+	if failed {
+		return errors.New("Verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	var stderr bytes.Buffer
+	code := run([]string{"apply", "../../test/testpatch.bps", "../../test/sourceFile", output}, &bytes.Buffer{}, &stderr)
+	if code != 0 {
+		t.Fatalf("bps apply exited %d: %s", code, stderr.String())
+	}
+
+	expected, _ := os.ReadFile("../../test/targetFile")
+	actual, _ := os.ReadFile(output)
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("bps apply did not write the target")
+	}
+}
+
+func TestApplyWrongSource(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	var stderr bytes.Buffer
+	code := run([]string{"apply", "../../test/testpatch.bps", "../../test/targetFile", output}, &bytes.Buffer{}, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "Source is 92 bytes, patch expects 45") {
+		t.Fatalf("bps apply exited %d for the wrong source: %s", code, stderr.String())
+	}
+
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("bps apply wrote output for the wrong source")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"apply"}, {"create", "a", "b"}, {"create", "-bogus", "a", "b", "c"}, {"verify", "-apply", "a"}, {"frobnicate"}} {
+		var stderr bytes.Buffer
+		if code := run(args, &bytes.Buffer{}, &stderr); code != 2 || !strings.Contains(stderr.String(), "Usage") {
+			t.Fatalf("bps %v exited %d: %s", args, code, stderr.String())
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	patch := filepath.Join(dir, "patch.bps")
+	output := filepath.Join(dir, "output")
+
+	var stderr bytes.Buffer
+	code := run([]string{"create", "-metadata", "created", "../../test/sourceFile", "../../test/targetFile", patch}, &bytes.Buffer{}, &stderr)
+	if code != 0 {
+		t.Fatalf("bps create exited %d: %s", code, stderr.String())
+	}
+
+	code = run([]string{"apply", patch, "../../test/sourceFile", output}, &bytes.Buffer{}, &stderr)
+	if code != 0 {
+		t.Fatalf("bps apply of a created patch exited %d: %s", code, stderr.String())
+	}
+
+	expected, _ := os.ReadFile("../../test/targetFile")
+	actual, _ := os.ReadFile(output)
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("Created patch did not reproduce the target")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"info", "../../test/testpatch.bps"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("bps info exited %d: %s", code, stderr.String())
+	}
+
+	for _, expected := range []string{"Source size:", "Target checksum: 76c91265", "SourceRead"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Fatalf("bps info output missing %q:\n%s", expected, stdout.String())
+		}
+	}
+}
+
+func TestInfoJSON(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"info", "-json", "../../test/testpatch.bps"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("bps info -json exited %d: %s", code, stderr.String())
+	}
+
+	var output struct {
+		Patch struct {
+			TargetChecksum string `json:"target_checksum"`
+		} `json:"patch"`
+		Actions int `json:"actions"`
+		Stats   map[string]struct {
+			Count int `json:"count"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		t.Fatalf("bps info -json produced invalid JSON: %s", err)
+	}
+
+	if output.Patch.TargetChecksum != "76c91265" || output.Actions == 0 || len(output.Stats) != 4 {
+		t.Fatalf("bps info -json output incorrect: %s", stdout.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"verify", "-apply", "../../test/testpatch.bps", "../../test/sourceFile"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("bps verify exited %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	for _, check := range []string{"Patch checksum", "Source checksum", "Target checksum"} {
+		if !strings.Contains(stdout.String(), check) {
+			t.Fatalf("bps verify did not report on %s:\n%s", check, stdout.String())
+		}
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	data, _ := os.ReadFile("../../test/testpatch.bps")
+	data[10] ^= 0x01
+	corrupted := filepath.Join(t.TempDir(), "corrupted.bps")
+	os.WriteFile(corrupted, data, 0644)
+
+	cases := map[string][]string{
+		"corrupted patch": {"verify", corrupted},
+		"wrong source":    {"verify", "../../test/testpatch.bps", "../../test/targetFile"},
+	}
+
+	for name, args := range cases {
+		var stdout, stderr bytes.Buffer
+		code := run(args, &stdout, &stderr)
+		if code != 1 || !strings.Contains(stdout.String(), "FAILED") {
+			t.Fatalf("bps verify with a %s exited %d:\n%s%s", name, code, stdout.String(), stderr.String())
+		}
+	}
+}
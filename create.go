@@ -0,0 +1,127 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Create a BPS patch that transforms source into target.  This is a simple
+// "linear" encoder: runs of bytes that are unchanged at the same offset in
+// source and target become SourceRead actions, and everything else is stored
+// verbatim in the patch as TargetRead actions.  The patch is applied to source
+// before it is returned, failing if it does not reproduce target.
+func CreatePatch(source, target []byte, metadata string) (*BPSPatch, error) {
+	var actions bytes.Buffer
+
+	source_matches := func(offset int) bool {
+		return offset < len(source) && source[offset] == target[offset]
+	}
+
+	output_offset := 0
+	for output_offset < len(target) {
+		start := output_offset
+
+		// Consume the run of bytes that already match the source
+		for output_offset < len(target) && source_matches(output_offset) {
+			output_offset++
+		}
+		if output_offset > start {
+			err := write_action(&actions, SourceRead, uint64(output_offset-start))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Otherwise gather up bytes until the source matches again
+		for output_offset < len(target) && !source_matches(output_offset) {
+			output_offset++
+		}
+		err := write_action(&actions, TargetRead, uint64(output_offset-start))
+		if err != nil {
+			return nil, err
+		}
+		actions.Write(target[start:output_offset])
+	}
+
+	patch := &BPSPatch{
+		SourceSize:     uint64(len(source)),
+		TargetSize:     uint64(len(target)),
+		MetadataSize:   uint64(len(metadata)),
+		Metadata:       metadata,
+		Actions:        actions.Bytes(),
+		SourceChecksum: crc32.ChecksumIEEE(source),
+		TargetChecksum: crc32.ChecksumIEEE(target),
+	}
+
+	// Serializing fills in the PatchChecksum
+	_, err := patch.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.self_check(source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return patch, nil
+}
+
+// Apply a newly created patch to source and confirm it reproduces target, so
+// that an encoder bug fails when the patch is created rather than wherever it
+// is later applied
+func (patch *BPSPatch) self_check(source, target []byte) error {
+	// The limits only guard against hostile patches, which this is not
+	produced, err := patch.ApplyWithOptions(source, ApplyOptions{MaxSourceSize: patch.SourceSize, MaxTargetSize: patch.TargetSize})
+	if err != nil {
+		return fmt.Errorf("Created patch does not apply: %w", err)
+	}
+	if !bytes.Equal(produced, target) {
+		return errors.New("Created patch does not reproduce the target")
+	}
+	return nil
+}
+
+// Create the serialized patch from source to target, for building test
+// fixtures from readable definitions rather than checking in opaque binaries.
+// The delta encoder is deterministic, so the same inputs always produce the
+// same bytes.  Panics if the patch cannot be created, which only happens if
+// the encoder is broken.
+func GenerateTestPatch(source, target []byte, metadata string) []byte {
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{Metadata: metadata})
+	if err != nil {
+		panic(fmt.Sprintf("GenerateTestPatch: %s", err))
+	}
+
+	data, err := patch.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("GenerateTestPatch: %s", err))
+	}
+	return data
+}
+
+// Write an action header for the given action number and length.  Lengths are
+// stored minus one, as a zero length action is meaningless
+func write_action(bytewriter *bytes.Buffer, action_num uint64, length uint64) error {
+	return bps_write_num(bytewriter, ((length-1)<<2)|action_num)
+}
+
+// Create a patch which undoes this one, turning the target back into the
+// source.  Both the source and target are checked against the patch
+// checksums first, and the reverse patch keeps this patch's metadata.
+func (patch *BPSPatch) Reverse(source, target []byte) (*BPSPatch, error) {
+	calculated_source_checksum := crc32.ChecksumIEEE(source)
+	if calculated_source_checksum != patch.SourceChecksum {
+		return nil, &ChecksumError{Kind: ChecksumSource, Expected: patch.SourceChecksum, Actual: calculated_source_checksum}
+	}
+
+	calculated_target_checksum := crc32.ChecksumIEEE(target)
+	if calculated_target_checksum != patch.TargetChecksum {
+		return nil, &ChecksumError{Kind: ChecksumTarget, Expected: patch.TargetChecksum, Actual: calculated_target_checksum}
+	}
+
+	return CreatePatchDelta(target, source, EncodeOptions{Metadata: patch.Metadata})
+}
@@ -0,0 +1,185 @@
+package bps
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write source data to a temporary file and apply the patch to it
+func apply_via_file(patch *BPSPatch, source []byte, t *testing.T) []byte {
+	path := filepath.Join(t.TempDir(), "source")
+	if err := os.WriteFile(path, source, 0644); err != nil {
+		t.Fatalf("Could not write temporary source file: %s", err)
+	}
+
+	sourcefile, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open temporary source file: %s", err)
+	}
+	defer sourcefile.Close()
+
+	target, err := patch.PatchSourceFile(sourcefile)
+	if err != nil {
+		t.Fatalf("PatchSourceFile returned an error: %s", err)
+	}
+
+	return target
+}
+
+func TestCreatePatchRoundTrip(t *testing.T) {
+	source := []byte("The quick brown fox jumps over the lazy dog")
+	target := []byte("The quick red fox jumps over the lazy dog, twice")
+
+	patch, err := CreatePatch(source, target, "test metadata")
+	if err != nil {
+		t.Fatalf("CreatePatch returned an error: %s", err)
+	}
+
+	if patch.SourceSize != uint64(len(source)) || patch.TargetSize != uint64(len(target)) {
+		t.Fatalf("CreatePatch sizes incorrect: %d, %d", patch.SourceSize, patch.TargetSize)
+	}
+
+	if patch.Metadata != "test metadata" || patch.MetadataSize != 13 {
+		t.Fatalf("CreatePatch metadata incorrect: %q (%d)", patch.Metadata, patch.MetadataSize)
+	}
+
+	if !bytes.Equal(apply_via_file(patch, source, t), target) {
+		t.Fatalf("Created patch did not reproduce the target")
+	}
+}
+
+func TestCreatePatchFixtureRoundTrip(t *testing.T) {
+	source, _ := os.ReadFile("test/sourceFile")
+	target, _ := os.ReadFile("test/targetFile")
+
+	patch, err := CreatePatch(source, target, "")
+	if err != nil {
+		t.Fatalf("CreatePatch returned an error: %s", err)
+	}
+
+	// Same inputs as the beat generated fixture, so the checksums must agree
+	if patch.SourceChecksum != 0x133070d || patch.TargetChecksum != 0x76c91265 {
+		t.Fatalf("CreatePatch checksums incorrect: %x, %x", patch.SourceChecksum, patch.TargetChecksum)
+	}
+
+	if !bytes.Equal(apply_via_file(patch, source, t), target) {
+		t.Fatalf("Created patch did not reproduce the target")
+	}
+}
+
+func TestCreatePatchChecksumMatchesSerialization(t *testing.T) {
+	patch, err := CreatePatch([]byte("source"), []byte("target"), "")
+	if err != nil {
+		t.Fatalf("CreatePatch returned an error: %s", err)
+	}
+
+	serialized, _ := patch.MarshalBinary()
+	reparsed, err := FromBytes(serialized)
+	if err != nil {
+		t.Fatalf("Serialized patch did not parse: %s", err)
+	}
+
+	compare_bps(patch, &reparsed, t)
+}
+
+func TestReverse(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{Metadata: "forward"})
+	if err != nil {
+		t.Fatalf("CreatePatchDelta returned an error: %s", err)
+	}
+
+	patched, err := patch.PatchSourceBytes(source)
+	if err != nil {
+		t.Fatalf("PatchSourceBytes returned an error: %s", err)
+	}
+
+	reverse, err := patch.Reverse(source, patched)
+	if err != nil {
+		t.Fatalf("Reverse returned an error: %s", err)
+	}
+
+	if reverse.SourceSize != patch.TargetSize || reverse.TargetSize != patch.SourceSize ||
+		reverse.SourceChecksum != patch.TargetChecksum || reverse.TargetChecksum != patch.SourceChecksum {
+		t.Fatalf("Reverse patch did not swap sizes and checksums")
+	}
+
+	unpatched, err := reverse.PatchSourceBytes(patched)
+	if err != nil {
+		t.Fatalf("Applying the reverse patch returned an error: %s", err)
+	}
+
+	if !bytes.Equal(unpatched, source) {
+		t.Fatalf("Reverse patch did not restore the original source")
+	}
+}
+
+func TestReverseWrongTarget(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	if _, err := patch.Reverse(source, source); err == nil {
+		t.Fatalf("Reverse accepted a target that does not match the patch")
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{SkipSelfCheck: true})
+	if err != nil {
+		t.Fatalf("CreatePatchDelta returned an error: %s", err)
+	}
+	if err := patch.self_check(source, target); err != nil {
+		t.Fatalf("self_check rejected a good patch: %s", err)
+	}
+
+	// A TargetRead byte changed along with the target checksum still
+	// applies cleanly, but not to the target
+	corrupt := patch.Clone()
+	corrupt.Actions[1] ^= 0xff
+	produced, _ := corrupt.ApplyWithOptions(source, ApplyOptions{SkipTargetChecksum: true})
+	corrupt.TargetChecksum = crc32.ChecksumIEEE(produced)
+	if err := corrupt.self_check(source, target); err == nil {
+		t.Fatalf("self_check accepted a patch which does not reproduce the target")
+	}
+
+	// A truncated action list does not apply at all
+	corrupt = patch.Clone()
+	corrupt.Actions = corrupt.Actions[:len(corrupt.Actions)/2]
+	if err := corrupt.self_check(source, target); err == nil {
+		t.Fatalf("self_check accepted a patch which does not apply")
+	}
+}
+
+func TestGenerateTestPatchFixture(t *testing.T) {
+	// Regenerate the text diff fixture from the files it was made from
+	source, _ := os.ReadFile("test/sourceFile")
+	target, _ := os.ReadFile("test/targetFile")
+	fixturefile, _ := os.Open("test/testpatch.bps")
+	fixture, _ := FromFile(fixturefile)
+
+	data := GenerateTestPatch(source, target, "")
+	if !bytes.Equal(GenerateTestPatch(source, target, ""), data) {
+		t.Fatalf("GenerateTestPatch is not deterministic")
+	}
+
+	patch, err := FromBytes(data)
+	if err != nil {
+		t.Fatalf("Generated patch did not parse: %s", err)
+	}
+
+	// The fixture is a single TargetRead, so the actions differ, but the
+	// header must agree
+	if patch.SourceSize != fixture.SourceSize || patch.TargetSize != fixture.TargetSize ||
+		patch.SourceChecksum != fixture.SourceChecksum || patch.TargetChecksum != fixture.TargetChecksum {
+		t.Fatalf("Generated patch header %+v does not match the fixture %+v", patch, fixture)
+	}
+
+	if !bytes.Equal(apply_via_file(&patch, source, t), target) {
+		t.Fatalf("Generated patch did not reproduce the target")
+	}
+}
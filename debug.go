@@ -0,0 +1,107 @@
+package bps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Apply the patch and compare the result against a known good target, such as
+// the output of another patching tool.  Returns the index of the first byte
+// that differs, or -1 if the output matches.  A target checksum mismatch does
+// not stop the comparison, and is returned alongside the index; any other
+// failure to apply returns -1 and the error.
+func (patch *BPSPatch) ApplyAndCompare(source, expectedTarget []byte) (firstDiff int, err error) {
+	target, err := patch.PatchSourceBytes(source)
+
+	var checksum_err *ChecksumError
+	if err != nil && !(errors.As(err, &checksum_err) && checksum_err.Kind == ChecksumTarget) {
+		return -1, err
+	}
+
+	return first_difference(target, expectedTarget), err
+}
+
+// Find the index of the first byte that differs between a and b, counting the
+// end of the shorter slice as a difference.  Returns -1 if they are equal.
+func first_difference(a, b []byte) int {
+	length := match_length(a, b)
+	if length == len(a) && length == len(b) {
+		return -1
+	}
+	return length
+}
+
+// Check the whole create, serialize, parse and apply cycle for source and
+// target: a patch is created with CreatePatchDelta, serialized, parsed back
+// and applied to source, and the output compared with target.  Returns an
+// error naming whichever step failed.  Intended for tests of tools that build
+// on this package, as an assertion that their inputs produce valid patches.
+func RoundTrip(source, target []byte, metadata string) error {
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{Metadata: metadata})
+	if err != nil {
+		return fmt.Errorf("Creating patch: %w", err)
+	}
+
+	serialized, err := patch.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Serializing patch: %w", err)
+	}
+
+	reparsed, err := FromBytes(serialized)
+	if err != nil {
+		return fmt.Errorf("Parsing serialized patch: %w", err)
+	}
+	if !reparsed.Equal(patch) {
+		return errors.New("Parsing serialized patch: parsed patch differs from the created one")
+	}
+
+	first_diff, err := reparsed.ApplyAndCompare(source, target)
+	if err != nil {
+		return fmt.Errorf("Applying patch: %w", err)
+	}
+	if first_diff >= 0 {
+		return fmt.Errorf("Applying patch: output differs from target at byte %d", first_diff)
+	}
+
+	return nil
+}
+
+// An action as ApplyTrace applied it, with its offsets resolved
+type TracedAction struct {
+	Action
+	// Where in the target the action started writing
+	OutputOffset uint64
+	// Where a SourceRead or SourceCopy read the source from, or a TargetCopy
+	// read the target from.  Zero for a TargetRead.
+	ReadOffset uint64
+}
+
+// Apply the patch as PatchSourceBytes does, also returning every action in the
+// order it was applied.  The trace is recorded as the actions are applied and
+// returned even when applying fails, covering every action applied before the
+// failure, so it is empty if the source is rejected.  Together with
+// ApplyAndCompare the action which wrote the first wrong byte can be found:
+// it is the one whose OutputOffset and Length span the byte.  For debugging
+// only, as the trace holds an entry per action.
+func (patch *BPSPatch) ApplyTrace(source_data []byte) ([]byte, []TracedAction, error) {
+	var trace []TracedAction
+	opts := ApplyOptions{on_applied: func(action *resolved_action) {
+		traced := TracedAction{
+			Action: Action{
+				Kind:           int(action.action_num),
+				Length:         action.length,
+				RelativeOffset: action.relative_offset,
+				Data:           action.payload,
+			},
+			OutputOffset: action.output_offset,
+		}
+		if action.action_num != TargetRead {
+			traced.ReadOffset = action.read_offset
+		}
+		trace = append(trace, traced)
+	}}
+
+	target_data, err := patch.apply_bytes(context.Background(), source_data, nil, opts)
+	return target_data, trace, err
+}
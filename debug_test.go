@@ -0,0 +1,140 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestApplyAndCompare(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+	patch, _ := FromFile(patchfile)
+
+	firstDiff, err := patch.ApplyAndCompare(sourcedata, expectedtargetdata)
+	if err != nil || firstDiff != -1 {
+		t.Fatalf("ApplyAndCompare reported a difference for matching output: %d, %v", firstDiff, err)
+	}
+
+	altered := append([]byte{}, expectedtargetdata...)
+	altered[30] ^= 0xff
+	firstDiff, err = patch.ApplyAndCompare(sourcedata, altered)
+	if err != nil || firstDiff != 30 {
+		t.Fatalf("ApplyAndCompare reported %d, %v for a difference at 30", firstDiff, err)
+	}
+
+	firstDiff, _ = patch.ApplyAndCompare(sourcedata, expectedtargetdata[:50])
+	if firstDiff != 50 {
+		t.Fatalf("ApplyAndCompare reported %d for a truncated expected target", firstDiff)
+	}
+}
+
+func TestApplyAndCompareBadTarget(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+	patch, _ := FromFile(patchfile)
+
+	// Break a TargetRead payload so the patch itself produces the wrong output
+	patch.Actions = append([]byte{}, patch.Actions...)
+	patch.Actions[5] ^= 0xff
+
+	var checksum_err *ChecksumError
+	firstDiff, err := patch.ApplyAndCompare(sourcedata, expectedtargetdata)
+	if !errors.As(err, &checksum_err) || firstDiff != 3 {
+		t.Fatalf("ApplyAndCompare reported %d, %v for a corrupted TargetRead", firstDiff, err)
+	}
+
+	firstDiff, err = patch.ApplyAndCompare(expectedtargetdata[:patch.SourceSize], expectedtargetdata)
+	if err == nil || firstDiff != -1 {
+		t.Fatalf("ApplyAndCompare did not fail for the wrong source")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	source, target := synthetic_rom(1 << 14)
+
+	cases := []struct{ source, target []byte }{
+		{source, target},
+		{nil, nil},
+		{nil, []byte("target only")},
+		{[]byte("source only"), nil},
+	}
+
+	for _, c := range cases {
+		if err := RoundTrip(c.source, c.target, "round trip"); err != nil {
+			t.Fatalf("RoundTrip of %d to %d bytes failed: %s", len(c.source), len(c.target), err)
+		}
+	}
+
+	if err := RoundTrip(source, target, "bad \xff metadata"); err == nil || !strings.HasPrefix(err.Error(), "Parsing serialized patch") {
+		t.Fatalf("RoundTrip did not fail parsing invalid metadata: %v", err)
+	}
+}
+
+func TestApplyTrace(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	targetdata, trace, err := patch.ApplyTrace(source)
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("ApplyTrace did not apply the patch: %v", err)
+	}
+
+	actions, _ := patch.DecodeActions()
+	if len(trace) != len(actions) {
+		t.Fatalf("ApplyTrace recorded %d actions, the patch has %d", len(trace), len(actions))
+	}
+
+	var output_offset uint64
+	for i, traced := range trace {
+		if !traced.Action.equal(actions[i]) || traced.OutputOffset != output_offset {
+			t.Fatalf("Traced action %d is %+v, expected %+v at %d", i, traced, actions[i], output_offset)
+		}
+		if traced.Kind == TargetCopy && traced.ReadOffset >= traced.OutputOffset {
+			t.Fatalf("Traced TargetCopy %d reads from %d, past its output at %d", i, traced.ReadOffset, traced.OutputOffset)
+		}
+		output_offset += traced.Length
+	}
+}
+
+func TestApplyTraceFailure(t *testing.T) {
+	source := []byte("0123456789")
+	var encoded bytes.Buffer
+	write_action(&encoded, SourceRead, 4)
+	write_action(&encoded, TargetRead, 2)
+	encoded.WriteString("ab")
+	write_action(&encoded, TargetCopy, 4)
+	write_relative_offset(&encoded, 8)
+
+	// The target checksum cannot match, and the TargetCopy reads ahead of
+	// the output, so the trace stops before it
+	patch := craft_patch(source, 10, encoded.Bytes())
+	_, trace, err := patch.ApplyTrace(source)
+	if err == nil {
+		t.Fatalf("ApplyTrace applied a broken patch")
+	}
+	if len(trace) != 2 || trace[1].Kind != TargetRead || trace[1].OutputOffset != 4 {
+		t.Fatalf("ApplyTrace recorded %+v before failing", trace)
+	}
+}
+
+func TestApplyTraceWrongSource(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	// No action is applied to a rejected source, so none is traced
+	wrong_source := append([]byte(nil), source...)
+	wrong_source[0] ^= 0x01
+	_, trace, err := patch.ApplyTrace(wrong_source)
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumSource {
+		t.Fatalf("ApplyTrace of the wrong source returned %v, expected a source checksum error", err)
+	}
+	if len(trace) != 0 {
+		t.Fatalf("ApplyTrace traced %d actions for a rejected source", len(trace))
+	}
+}
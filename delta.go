@@ -0,0 +1,345 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"math"
+)
+
+const (
+	// Default minimum match length for the delta encoder
+	default_min_match = 4
+	// How many earlier positions sharing a hash are examined before the
+	// encoder gives up looking for a longer match
+	max_chain_length = 32
+	// Multiplier for the rolling window hash
+	rolling_hash_base = 0x01000193
+)
+
+// Options controlling CreatePatchDelta
+type EncodeOptions struct {
+	// Minimum number of bytes a source or target match must cover before it
+	// is encoded as a copy action instead of literal target data.  Zero
+	// selects the default of 4 bytes.  Smaller values find more matches and
+	// so smaller patches, but encode slower; larger values encode faster.
+	// A copy costs a varint header plus, for SourceCopy and TargetCopy, a
+	// varint offset, so matches shorter than those few bytes are not worth
+	// emitting at all.
+	MinMatch int
+
+	// Metadata string stored in the produced patch
+	Metadata string
+
+	// Skip applying the patch to the source to confirm it reproduces the
+	// target before returning it.  This roughly halves the cost of creating
+	// a patch, but leaves any encoder bug to show up when it is applied.
+	SkipSelfCheck bool
+}
+
+func (opts EncodeOptions) min_match() int {
+	if opts.MinMatch <= 0 {
+		return default_min_match
+	}
+	return opts.MinMatch
+}
+
+// Create a BPS patch that transforms source into target, using SourceCopy and
+// TargetCopy actions wherever the target repeats data found elsewhere in the
+// source or earlier in the target.  This produces far smaller patches than
+// CreatePatch when data moves around, at the cost of a slower encode.
+//
+// The patch depends only on source, target and opts, so the same inputs
+// always produce byte identical patches, across runs and platforms.  Patches
+// can be cached by content or signed on the strength of that.
+//
+// Unless opts.SkipSelfCheck is set, the patch is applied to source before it
+// is returned, failing if it does not reproduce target.
+func CreatePatchDelta(source, target []byte, opts EncodeOptions) (*BPSPatch, error) {
+	encoder := delta_encoder{
+		source:    source,
+		target:    target,
+		min_match: opts.min_match(),
+	}
+
+	err := encoder.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	patch := &BPSPatch{
+		SourceSize:     uint64(len(source)),
+		TargetSize:     uint64(len(target)),
+		MetadataSize:   uint64(len(opts.Metadata)),
+		Metadata:       opts.Metadata,
+		Actions:        encoder.actions.Bytes(),
+		SourceChecksum: crc32.ChecksumIEEE(source),
+		TargetChecksum: crc32.ChecksumIEEE(target),
+	}
+
+	// Serializing fills in the PatchChecksum
+	_, err = patch.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.SkipSelfCheck {
+		err = patch.self_check(source, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return patch, nil
+}
+
+// Report the size in bytes of the patch CreatePatchDelta would create from the
+// same arguments, without creating it.  The same matching is done, so this
+// takes about as long as creating the patch with SkipSelfCheck set, but the
+// actions are only counted rather than held in memory.
+func EstimatePatchSize(source, target []byte, opts EncodeOptions) (int, error) {
+	encoder := delta_encoder{
+		source:     source,
+		target:     target,
+		min_match:  opts.min_match(),
+		count_only: true,
+	}
+
+	err := encoder.encode()
+	if err != nil {
+		return 0, err
+	}
+
+	header_size := len(Magic) + VarintLen(uint64(len(source))) + VarintLen(uint64(len(target))) +
+		VarintLen(uint64(len(opts.Metadata))) + len(opts.Metadata)
+	return header_size + encoder.counted + FooterSize, nil
+}
+
+// Holds the matching state for a single CreatePatchDelta call.  Both the
+// source and target are indexed by the hash of every min_match sized window,
+// with earlier positions sharing a hash chained together, zlib style.
+// Everything is kept in slices rather than maps so the output is
+// deterministic.
+type delta_encoder struct {
+	source    []byte
+	target    []byte
+	min_match int
+
+	actions bytes.Buffer
+
+	// Only count the size of the actions in counted rather than writing
+	// them to actions
+	count_only bool
+	counted    int
+
+	source_relative_offset int
+	target_relative_offset int
+
+	// Start of literal target bytes that have not yet been written out as a
+	// TargetRead
+	pending_offset int
+
+	hash_mask   uint32
+	source_head []int
+	source_prev []int
+	target_head []int
+	target_prev []int
+}
+
+func (encoder *delta_encoder) encode() error {
+	source_hashes := rolling_hashes(encoder.source, encoder.min_match)
+	target_hashes := rolling_hashes(encoder.target, encoder.min_match)
+
+	table_size := 1
+	for table_size < len(source_hashes)+len(target_hashes) {
+		table_size <<= 1
+	}
+	encoder.hash_mask = uint32(table_size - 1)
+
+	encoder.source_head = new_chain_heads(table_size)
+	encoder.source_prev = make([]int, len(source_hashes))
+	for offset, hash := range source_hashes {
+		bucket := hash & encoder.hash_mask
+		encoder.source_prev[offset] = encoder.source_head[bucket]
+		encoder.source_head[bucket] = offset
+	}
+
+	// Target positions are only indexed once the encoder has moved past them,
+	// as a TargetCopy can only reference data which has already been written
+	encoder.target_head = new_chain_heads(table_size)
+	encoder.target_prev = make([]int, len(target_hashes))
+
+	output_offset := 0
+	indexed_offset := 0
+	for output_offset < len(encoder.target) {
+		action_num, match_offset, length := encoder.find_match(output_offset, target_hashes)
+
+		if length < encoder.min_match {
+			output_offset++
+		} else {
+			err := encoder.flush_pending(output_offset)
+			if err != nil {
+				return err
+			}
+			err = encoder.write_copy(action_num, match_offset, length)
+			if err != nil {
+				return err
+			}
+			output_offset += length
+			encoder.pending_offset = output_offset
+		}
+
+		for ; indexed_offset < output_offset && indexed_offset < len(target_hashes); indexed_offset++ {
+			bucket := target_hashes[indexed_offset] & encoder.hash_mask
+			encoder.target_prev[indexed_offset] = encoder.target_head[bucket]
+			encoder.target_head[bucket] = indexed_offset
+		}
+	}
+
+	return encoder.flush_pending(output_offset)
+}
+
+// Find the longest match for the target data at output_offset.  Returns the
+// action to encode it with, the offset the match was found at and its length
+func (encoder *delta_encoder) find_match(output_offset int, target_hashes []uint32) (action_num uint64, match_offset int, length int) {
+	remaining := encoder.target[output_offset:]
+
+	// A SourceRead is the cheapest possible action, as it needs no offset
+	if output_offset < len(encoder.source) {
+		action_num = SourceRead
+		match_offset = output_offset
+		length = match_length(encoder.source[output_offset:], remaining)
+	}
+
+	if output_offset >= len(target_hashes) {
+		return
+	}
+	bucket := target_hashes[output_offset] & encoder.hash_mask
+
+	candidate := encoder.source_head[bucket]
+	for chain := 0; candidate >= 0 && chain < max_chain_length; chain++ {
+		candidate_length := match_length(encoder.source[candidate:], remaining)
+		if candidate_length > length {
+			action_num, match_offset, length = SourceCopy, candidate, candidate_length
+		}
+		candidate = encoder.source_prev[candidate]
+	}
+
+	// Comparing against the full target allows a match to overlap the output
+	// position, which the byte at a time TargetCopy apply reproduces.  A run
+	// of one repeated byte so becomes a single TargetCopy of the byte before
+	// it, as the previous position is always first in its chain.
+	candidate = encoder.target_head[bucket]
+	for chain := 0; candidate >= 0 && chain < max_chain_length; chain++ {
+		candidate_length := match_length(encoder.target[candidate:], remaining)
+		if candidate_length > length {
+			action_num, match_offset, length = TargetCopy, candidate, candidate_length
+		}
+		candidate = encoder.target_prev[candidate]
+	}
+
+	return
+}
+
+// Write any literal bytes between the pending offset and output_offset as a
+// TargetRead action
+func (encoder *delta_encoder) flush_pending(output_offset int) error {
+	if output_offset == encoder.pending_offset {
+		return nil
+	}
+
+	length := output_offset - encoder.pending_offset
+	if encoder.count_only {
+		encoder.counted += VarintLen(uint64(length-1)<<2|TargetRead) + length
+	} else {
+		err := write_action(&encoder.actions, TargetRead, uint64(length))
+		if err != nil {
+			return err
+		}
+		encoder.actions.Write(encoder.target[encoder.pending_offset:output_offset])
+	}
+	encoder.pending_offset = output_offset
+
+	return nil
+}
+
+// Write a SourceRead, SourceCopy or TargetCopy action, encoding copy offsets
+// relative to the current source or target offset
+func (encoder *delta_encoder) write_copy(action_num uint64, match_offset int, length int) error {
+	var delta int64
+	switch action_num {
+	case SourceCopy:
+		delta = int64(match_offset - encoder.source_relative_offset)
+		encoder.source_relative_offset = match_offset + length
+	case TargetCopy:
+		delta = int64(match_offset - encoder.target_relative_offset)
+		encoder.target_relative_offset = match_offset + length
+	}
+
+	if encoder.count_only {
+		encoder.counted += VarintLen(uint64(length-1)<<2 | action_num)
+		if action_num != SourceRead {
+			encoder.counted += VarintLen(EncodeSignedOffset(delta))
+		}
+		return nil
+	}
+
+	err := write_action(&encoder.actions, action_num, uint64(length))
+	if err != nil || action_num == SourceRead {
+		return err
+	}
+	return write_relative_offset(&encoder.actions, delta)
+}
+
+// Write a relative offset, encoded with EncodeSignedOffset
+func write_relative_offset(bytewriter *bytes.Buffer, delta int64) error {
+	if delta == math.MinInt64 {
+		return errors.New("Relative offset math.MinInt64 cannot be encoded")
+	}
+	return bps_write_num(bytewriter, EncodeSignedOffset(delta))
+}
+
+// Calculate the hash of every window_size sized window in data
+func rolling_hashes(data []byte, window_size int) []uint32 {
+	if len(data) < window_size {
+		return nil
+	}
+
+	// base_power is rolling_hash_base to the power of window_size-1, used to
+	// remove the outgoing byte from the hash
+	var hash, base_power uint32 = 0, 1
+	for i := 0; i < window_size; i++ {
+		hash = hash*rolling_hash_base + uint32(data[i])
+		if i > 0 {
+			base_power *= rolling_hash_base
+		}
+	}
+
+	hashes := make([]uint32, len(data)-window_size+1)
+	hashes[0] = hash
+	for i := 1; i < len(hashes); i++ {
+		hash -= uint32(data[i-1]) * base_power
+		hash = hash*rolling_hash_base + uint32(data[i+window_size-1])
+		hashes[i] = hash
+	}
+
+	return hashes
+}
+
+// Create a hash chain head table with every bucket empty
+func new_chain_heads(size int) []int {
+	heads := make([]int, size)
+	for i := range heads {
+		heads[i] = -1
+	}
+	return heads
+}
+
+// Count how many leading bytes a and b have in common
+func match_length(a, b []byte) int {
+	length := 0
+	for length < len(a) && length < len(b) && a[length] == b[length] {
+		length++
+	}
+	return length
+}
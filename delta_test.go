@@ -0,0 +1,205 @@
+package bps
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Build a pseudo random "ROM" along with a modified copy of it in which blocks
+// have moved around, a header was inserted and a few bytes were changed
+func synthetic_rom(size int) (source []byte, target []byte) {
+	random := rand.New(rand.NewSource(1))
+
+	source = make([]byte, size)
+	random.Read(source)
+
+	target = append(target, []byte("INSERTED HEADER!")...)
+	target = append(target, source[size/2:]...)
+	target = append(target, source[:size/2]...)
+	target = append(target, bytes.Repeat([]byte{0xff}, 1024)...)
+	for i := 0; i < 64; i++ {
+		target[random.Intn(len(target))] ^= 0x55
+	}
+
+	return
+}
+
+func TestCreatePatchDeltaRoundTrip(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{Metadata: "delta"})
+	if err != nil {
+		t.Fatalf("CreatePatchDelta returned an error: %s", err)
+	}
+
+	if patch.Metadata != "delta" || patch.MetadataSize != 5 {
+		t.Fatalf("CreatePatchDelta metadata incorrect: %q (%d)", patch.Metadata, patch.MetadataSize)
+	}
+
+	if !bytes.Equal(apply_via_file(patch, source, t), target) {
+		t.Fatalf("Delta patch did not reproduce the target")
+	}
+}
+
+func TestCreatePatchDeltaFixtureRoundTrip(t *testing.T) {
+	source, _ := os.ReadFile("test/sourceFile")
+	target, _ := os.ReadFile("test/targetFile")
+
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{})
+	if err != nil {
+		t.Fatalf("CreatePatchDelta returned an error: %s", err)
+	}
+
+	if !bytes.Equal(apply_via_file(patch, source, t), target) {
+		t.Fatalf("Delta patch did not reproduce the target")
+	}
+}
+
+func TestCreatePatchDeltaSmallInputs(t *testing.T) {
+	cases := []struct{ source, target string }{
+		{"", ""},
+		{"", "abc"},
+		{"abc", ""},
+		{"abc", "abc"},
+		{"abcdefgh", "efghabcd"},
+		{"a", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	}
+
+	for _, c := range cases {
+		patch, err := CreatePatchDelta([]byte(c.source), []byte(c.target), EncodeOptions{MinMatch: 2})
+		if err != nil {
+			t.Fatalf("CreatePatchDelta(%q, %q) returned an error: %s", c.source, c.target, err)
+		}
+
+		if !bytes.Equal(apply_via_file(patch, []byte(c.source), t), []byte(c.target)) {
+			t.Fatalf("Delta patch for %q -> %q did not reproduce the target", c.source, c.target)
+		}
+	}
+}
+
+func TestCreatePatchDeltaSmallerThanLinear(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+
+	linear, _ := CreatePatch(source, target, "")
+	delta, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	if len(delta.Actions) >= len(linear.Actions)/10 {
+		t.Fatalf("Delta patch is not meaningfully smaller: %d vs %d bytes", len(delta.Actions), len(linear.Actions))
+	}
+}
+
+func BenchmarkCreatePatchSize(b *testing.B) {
+	source, target := synthetic_rom(1 << 20)
+
+	b.Run("linear", func(b *testing.B) {
+		var patch *BPSPatch
+		for i := 0; i < b.N; i++ {
+			patch, _ = CreatePatch(source, target, "")
+		}
+		serialized, _ := patch.MarshalBinary()
+		b.ReportMetric(float64(len(serialized)), "patch-bytes")
+	})
+
+	b.Run("delta", func(b *testing.B) {
+		var patch *BPSPatch
+		for i := 0; i < b.N; i++ {
+			patch, _ = CreatePatchDelta(source, target, EncodeOptions{})
+		}
+		serialized, _ := patch.MarshalBinary()
+		b.ReportMetric(float64(len(serialized)), "patch-bytes")
+	})
+}
+
+func TestCreatePatchDeltaDeterministic(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+
+	first, _ := CreatePatchDelta(source, target, EncodeOptions{Metadata: "build"})
+	first_data, _ := first.MarshalBinary()
+
+	for i := 0; i < 4; i++ {
+		again, _ := CreatePatchDelta(source, target, EncodeOptions{Metadata: "build"})
+		again_data, _ := again.MarshalBinary()
+		if !bytes.Equal(first_data, again_data) {
+			t.Fatalf("CreatePatchDelta run %d produced a different patch", i+2)
+		}
+	}
+}
+
+func TestCreatePatchDeltaRun(t *testing.T) {
+	source, _ := synthetic_rom(1 << 12)
+	target := append([]byte("header"), bytes.Repeat([]byte{0x00}, 1<<16)...)
+
+	patch, err := CreatePatchDelta(source, target, EncodeOptions{})
+	if err != nil {
+		t.Fatalf("CreatePatchDelta returned an error: %s", err)
+	}
+	if len(patch.Actions) > 16 {
+		t.Fatalf("A run of %d zero bytes took %d bytes of actions", 1<<16, len(patch.Actions))
+	}
+
+	actions, _ := patch.DecodeActions()
+	last := actions[len(actions)-1]
+	if last.Kind != TargetCopy || last.Length < 1<<15 {
+		t.Fatalf("Run encoded as %+v, expected one long TargetCopy", last)
+	}
+
+	targetdata, err := patch.PatchSourceBytes(source)
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("Run patch does not reproduce the target: %v", err)
+	}
+}
+
+func TestCreatePatchDeltaMinMatch(t *testing.T) {
+	// A target of short phrases taken from all over the source, which only a
+	// small MinMatch finds
+	random := rand.New(rand.NewSource(2))
+	source := make([]byte, 1<<12)
+	random.Read(source)
+	var target []byte
+	for len(target) < 1<<12 {
+		offset := random.Intn(len(source) - 8)
+		target = append(target, source[offset:offset+8]...)
+	}
+
+	short, _ := CreatePatchDelta(source, target, EncodeOptions{MinMatch: 4})
+	long, _ := CreatePatchDelta(source, target, EncodeOptions{MinMatch: 32})
+	if len(short.Actions) >= len(long.Actions) {
+		t.Fatalf("MinMatch 4 produced %d bytes of actions, MinMatch 32 %d", len(short.Actions), len(long.Actions))
+	}
+
+	for _, patch := range []*BPSPatch{short, long} {
+		targetdata, err := patch.PatchSourceBytes(source)
+		if err != nil || !bytes.Equal(targetdata, target) {
+			t.Fatalf("MinMatch patch does not reproduce the target: %v", err)
+		}
+	}
+}
+
+func TestEstimatePatchSize(t *testing.T) {
+	source, target := synthetic_rom(1 << 14)
+	run := append([]byte("header"), bytes.Repeat([]byte{0x00}, 1<<12)...)
+
+	for _, c := range []struct {
+		source, target []byte
+		opts           EncodeOptions
+	}{
+		{source, target, EncodeOptions{}},
+		{source, target, EncodeOptions{MinMatch: 16, Metadata: "estimate"}},
+		{source, run, EncodeOptions{}},
+		{nil, target, EncodeOptions{}},
+		{source, nil, EncodeOptions{}},
+	} {
+		estimate, err := EstimatePatchSize(c.source, c.target, c.opts)
+		if err != nil {
+			t.Fatalf("EstimatePatchSize returned an error: %s", err)
+		}
+
+		patch, _ := CreatePatchDelta(c.source, c.target, c.opts)
+		data, _ := patch.MarshalBinary()
+		if estimate != len(data) {
+			t.Fatalf("EstimatePatchSize estimated %d bytes, the patch is %d", estimate, len(data))
+		}
+	}
+}
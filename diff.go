@@ -0,0 +1,134 @@
+package bps
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// How two patches differ, as reported by DiffPatches
+type PatchDiff struct {
+	// Header and footer fields which differ, in the order they are stored
+	Fields []FieldDiff
+
+	// Action statistics of each patch
+	StatsA PatchStats
+	StatsB PatchStats
+
+	// Index of the first action which differs between the patches, or -1 if
+	// their actions are identical
+	FirstAction int
+}
+
+// A header or footer field which differs between two patches, with each
+// patch's value formatted for printing
+type FieldDiff struct {
+	Field string
+	A     string
+	B     string
+}
+
+// Compare two patches field by field and action by action, for tracking down
+// why two encoders produce different patches for the same files.  Fails only
+// if either patch's actions cannot be decoded.
+func DiffPatches(a, b *BPSPatch) (*PatchDiff, error) {
+	diff := &PatchDiff{FirstAction: -1}
+
+	compare := func(field string, value_a, value_b string) {
+		if value_a != value_b {
+			diff.Fields = append(diff.Fields, FieldDiff{Field: field, A: value_a, B: value_b})
+		}
+	}
+	compare("SourceSize", fmt.Sprint(a.SourceSize), fmt.Sprint(b.SourceSize))
+	compare("TargetSize", fmt.Sprint(a.TargetSize), fmt.Sprint(b.TargetSize))
+	compare("Metadata", fmt.Sprintf("%q", a.Metadata), fmt.Sprintf("%q", b.Metadata))
+	compare("SourceChecksum", fmt.Sprintf("%08x", a.SourceChecksum), fmt.Sprintf("%08x", b.SourceChecksum))
+	compare("TargetChecksum", fmt.Sprintf("%08x", a.TargetChecksum), fmt.Sprintf("%08x", b.TargetChecksum))
+	compare("PatchChecksum", fmt.Sprintf("%08x", a.PatchChecksum), fmt.Sprintf("%08x", b.PatchChecksum))
+
+	actions_a, err := a.DecodeActions()
+	if err != nil {
+		return nil, fmt.Errorf("Patch A: %w", err)
+	}
+	actions_b, err := b.DecodeActions()
+	if err != nil {
+		return nil, fmt.Errorf("Patch B: %w", err)
+	}
+
+	for _, action := range actions_a {
+		diff.StatsA.add(action)
+	}
+	for _, action := range actions_b {
+		diff.StatsB.add(action)
+	}
+
+	for i := 0; i < len(actions_a) || i < len(actions_b); i++ {
+		if i >= len(actions_a) || i >= len(actions_b) || !actions_a[i].equal(actions_b[i]) {
+			diff.FirstAction = i
+			break
+		}
+	}
+
+	return diff, nil
+}
+
+// Report whether the patches compared were identical
+func (diff *PatchDiff) Equal() bool {
+	return len(diff.Fields) == 0 && diff.FirstAction == -1
+}
+
+// Describe the differences a line at a time, such as
+// "TargetCopy: A uses 12 more actions (30 against 18), A writes 400 more bytes"
+func (diff *PatchDiff) String() string {
+	if diff.Equal() {
+		return "Patches are identical\n"
+	}
+
+	var out strings.Builder
+	for _, field := range diff.Fields {
+		fmt.Fprintf(&out, "%s: A %s, B %s\n", field.Field, field.A, field.B)
+	}
+
+	for kind, name := range action_names {
+		count_a, count_b := diff.StatsA.Count[kind], diff.StatsB.Count[kind]
+		bytes_a, bytes_b := diff.StatsA.Bytes[kind], diff.StatsB.Bytes[kind]
+		if count_a == count_b && bytes_a == bytes_b {
+			continue
+		}
+
+		switch {
+		case count_a > count_b:
+			fmt.Fprintf(&out, "%s: A uses %d more actions (%d against %d)", name, count_a-count_b, count_a, count_b)
+		case count_b > count_a:
+			fmt.Fprintf(&out, "%s: B uses %d more actions (%d against %d)", name, count_b-count_a, count_a, count_b)
+		default:
+			fmt.Fprintf(&out, "%s: both use %d actions", name, count_a)
+		}
+		switch {
+		case bytes_a > bytes_b:
+			fmt.Fprintf(&out, ", A writes %d more bytes", bytes_a-bytes_b)
+		case bytes_b > bytes_a:
+			fmt.Fprintf(&out, ", B writes %d more bytes", bytes_b-bytes_a)
+		}
+		out.WriteString("\n")
+	}
+
+	if diff.FirstAction >= 0 {
+		fmt.Fprintf(&out, "Actions first differ at action %d\n", diff.FirstAction)
+	}
+
+	return out.String()
+}
+
+// Count one action into the statistics
+func (stats *PatchStats) add(action Action) {
+	stats.Actions++
+	stats.Count[action.Kind]++
+	stats.Bytes[action.Kind] += action.Length
+}
+
+// Report whether two decoded actions are the same
+func (action Action) equal(other Action) bool {
+	return action.Kind == other.Kind && action.Length == other.Length &&
+		action.RelativeOffset == other.RelativeOffset && bytes.Equal(action.Data, other.Data)
+}
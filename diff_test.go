@@ -0,0 +1,65 @@
+package bps
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffPatchesIdentical(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	a, _ := CreatePatchDelta(source, target, EncodeOptions{})
+	b := a.Clone()
+
+	diff, err := DiffPatches(a, b)
+	if err != nil {
+		t.Fatalf("DiffPatches returned an error: %s", err)
+	}
+	if !diff.Equal() || diff.String() != "Patches are identical\n" {
+		t.Fatalf("Identical patches reported as different:\n%s", diff)
+	}
+}
+
+func TestDiffPatchesEncoders(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	a, _ := CreatePatchDelta(source, target, EncodeOptions{Metadata: "delta"})
+	b, _ := CreatePatch(source, target, "linear")
+
+	diff, err := DiffPatches(a, b)
+	if err != nil {
+		t.Fatalf("DiffPatches returned an error: %s", err)
+	}
+	if diff.Equal() {
+		t.Fatalf("Patches from different encoders reported as identical")
+	}
+
+	fields := map[string]bool{}
+	for _, field := range diff.Fields {
+		fields[field.Field] = true
+	}
+	if !fields["Metadata"] || !fields["PatchChecksum"] || fields["SourceSize"] || fields["TargetChecksum"] {
+		t.Fatalf("DiffPatches reported the wrong fields: %+v", diff.Fields)
+	}
+
+	if diff.StatsA.Count[SourceCopy] == 0 || diff.StatsB.Count[SourceCopy] != 0 {
+		t.Fatalf("DiffPatches stats do not match the encoders: %+v, %+v", diff.StatsA, diff.StatsB)
+	}
+	if diff.FirstAction != 0 {
+		t.Fatalf("Actions first differ at %d, expected 0", diff.FirstAction)
+	}
+
+	description := diff.String()
+	for _, line := range []string{`Metadata: A "delta", B "linear"`, "SourceCopy: A uses", "Actions first differ at action 0"} {
+		if !strings.Contains(description, line) {
+			t.Fatalf("Description does not contain %q:\n%s", line, description)
+		}
+	}
+}
+
+func TestDiffPatchesInvalid(t *testing.T) {
+	good, _ := CreatePatch([]byte("source"), []byte("target"), "")
+	bad := craft_patch([]byte("source"), 6, []byte{0x00})
+
+	if _, err := DiffPatches(good, bad); err == nil {
+		t.Fatalf("DiffPatches accepted a patch with undecodable actions")
+	}
+}
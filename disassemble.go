@@ -0,0 +1,45 @@
+package bps
+
+import (
+	"fmt"
+	"io"
+)
+
+// Write a human readable listing of the patch actions to w, one line per
+// action, prefixed with the target offset the action writes to:
+//
+//	0x0000 SourceRead len=256
+//	0x0100 TargetRead len=5
+//	0x0105 TargetCopy len=12 reloff=-4
+//
+// The literal data of TargetRead actions is summarized by its length; use
+// DisassembleVerbose to include it.
+func (patch *BPSPatch) Disassemble(w io.Writer) error {
+	return patch.disassemble(w, false)
+}
+
+// Write the same listing as Disassemble, followed on each TargetRead by a hex
+// dump of the literal data stored in the patch
+func (patch *BPSPatch) DisassembleVerbose(w io.Writer) error {
+	return patch.disassemble(w, true)
+}
+
+func (patch *BPSPatch) disassemble(w io.Writer, verbose bool) error {
+	_, err := patch.walk_actions(func(action *resolved_action) error {
+		var err error
+		switch action.action_num {
+		case SourceRead:
+			_, err = fmt.Fprintf(w, "0x%04x SourceRead len=%d\n", action.output_offset, action.length)
+		case TargetRead:
+			_, err = fmt.Fprintf(w, "0x%04x TargetRead len=%d\n", action.output_offset, action.length)
+			if err == nil && verbose {
+				_, err = fmt.Fprintf(w, "       % x\n", action.payload)
+			}
+		case SourceCopy, TargetCopy:
+			_, err = fmt.Fprintf(w, "0x%04x %s len=%d reloff=%d\n", action.output_offset, action_names[action.action_num], action.length, action.relative_offset)
+		}
+		return err
+	})
+
+	return err
+}
@@ -0,0 +1,52 @@
+package bps
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	var encoded bytes.Buffer
+	write_action(&encoded, SourceRead, 4)
+	write_action(&encoded, TargetRead, 2)
+	encoded.WriteString("hi")
+	write_action(&encoded, TargetCopy, 3)
+	write_relative_offset(&encoded, 4)
+	write_action(&encoded, SourceCopy, 2)
+	write_relative_offset(&encoded, 6)
+
+	patch := craft_patch(make([]byte, 10), 11, encoded.Bytes())
+
+	var listing bytes.Buffer
+	if err := patch.Disassemble(&listing); err != nil {
+		t.Fatalf("Disassemble returned an error: %s", err)
+	}
+
+	expected := strings.Join([]string{
+		"0x0000 SourceRead len=4",
+		"0x0004 TargetRead len=2",
+		"0x0006 TargetCopy len=3 reloff=4",
+		"0x0009 SourceCopy len=2 reloff=6",
+		"",
+	}, "\n")
+
+	if listing.String() != expected {
+		t.Fatalf("Disassemble produced:\n%s", listing.String())
+	}
+
+	listing.Reset()
+	patch.DisassembleVerbose(&listing)
+	if !strings.Contains(listing.String(), "68 69") {
+		t.Fatalf("DisassembleVerbose did not dump TargetRead data:\n%s", listing.String())
+	}
+}
+
+func TestDisassembleBadActions(t *testing.T) {
+	patch := craft_patch(nil, 10, []byte{0x00})
+
+	var listing bytes.Buffer
+	if err := patch.Disassemble(&listing); err == nil {
+		t.Fatalf("Disassemble did not report a truncated action stream")
+	}
+}
@@ -0,0 +1,74 @@
+package bps
+
+import "fmt"
+
+// Identifies which of the three BPS checksums failed to verify
+type ChecksumKind int
+
+const (
+	// The source file does not match the one the patch was created for
+	ChecksumSource ChecksumKind = iota
+	// The patch produced a different target than the one it was created for
+	ChecksumTarget
+	// The patch file itself is corrupt
+	ChecksumPatch
+)
+
+func (kind ChecksumKind) String() string {
+	switch kind {
+	case ChecksumSource:
+		return "source"
+	case ChecksumTarget:
+		return "target"
+	case ChecksumPatch:
+		return "patch"
+	}
+	return fmt.Sprintf("ChecksumKind(%d)", int(kind))
+}
+
+// Returned when one of the checksums stored in a patch does not match the
+// checksum calculated from the actual data.  Use errors.As to tell a wrong
+// source file apart from a corrupt patch.
+type ChecksumError struct {
+	Kind     ChecksumKind
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumError) Error() string {
+	var hint string
+	switch e.Kind {
+	case ChecksumSource:
+		hint = "wrong source file?"
+	case ChecksumTarget:
+		hint = "patch produced the wrong output"
+	case ChecksumPatch:
+		hint = "patch file is corrupt"
+	}
+	return fmt.Sprintf("%s checksum mismatch: expected %08x, calculated %08x (%s)", e.Kind, e.Expected, e.Actual, hint)
+}
+
+// Returned when a source is not the size the patch was created for.  The
+// checksum would fail too, but the size says more about what is wrong.
+type SourceSizeError struct {
+	Expected uint64
+	Actual   uint64
+	// The source checksum the patch expects
+	checksum uint32
+}
+
+func (e *SourceSizeError) Error() string {
+	return fmt.Sprintf("Source is %d bytes, patch expects %d", e.Actual, e.Expected)
+}
+
+// A source of the wrong size is still the wrong source, so errors.As also
+// finds a source ChecksumError in a SourceSizeError.  Its Actual checksum is
+// zero, as the source is rejected before it is checksummed.
+func (e *SourceSizeError) As(target any) bool {
+	checksum_err, ok := target.(**ChecksumError)
+	if !ok {
+		return false
+	}
+	*checksum_err = &ChecksumError{Kind: ChecksumSource, Expected: e.checksum}
+	return true
+}
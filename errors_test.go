@@ -0,0 +1,117 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestSourceChecksumError(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	targetdata, _ := os.ReadFile("test/targetFile")
+	patch, _ := FromFile(patchfile)
+
+	_, err := patch.PatchSourceBytes(targetdata[:patch.SourceSize])
+
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) {
+		t.Fatalf("Wrong source did not return a ChecksumError: %v", err)
+	}
+
+	if checksum_err.Kind != ChecksumSource || checksum_err.Expected != patch.SourceChecksum {
+		t.Fatalf("Unexpected ChecksumError: %s", checksum_err)
+	}
+}
+
+func TestTargetChecksumError(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromFile(patchfile)
+	patch.TargetChecksum ^= 1
+
+	_, err := patch.PatchSourceBytes(sourcedata)
+
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumTarget {
+		t.Fatalf("Bad target did not return a target ChecksumError: %v", err)
+	}
+
+	if checksum_err.Actual != patch.TargetChecksum^1 {
+		t.Fatalf("ChecksumError has the wrong actual checksum: %s", checksum_err)
+	}
+}
+
+func TestPatchChecksumError(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	data[10] ^= 0xff
+
+	_, err := FromBytes(data)
+
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumPatch {
+		t.Fatalf("Corrupt patch did not return a patch ChecksumError: %v", err)
+	}
+
+	if checksum_err.Expected != 0xc18e4db1 {
+		t.Fatalf("ChecksumError has the wrong expected checksum: %s", checksum_err)
+	}
+}
+
+func TestTargetChecksumErrorReturnsTarget(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+	patch, _ := FromFile(patchfile)
+	patch.TargetChecksum = 0
+
+	targetdata, err := patch.PatchSourceBytes(sourcedata)
+
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumTarget {
+		t.Fatalf("Bad target did not return a target ChecksumError: %v", err)
+	}
+
+	if !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("Target data was not returned alongside the checksum error")
+	}
+
+	if checksum_err.Expected != 0 || checksum_err.Actual != crc32.ChecksumIEEE(targetdata) {
+		t.Fatalf("ChecksumError does not describe the returned target: %s", checksum_err)
+	}
+}
+
+func TestSourceChecksumErrorReturnsNothing(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	targetdata, err := patch.PatchSourceBytes(make([]byte, patch.SourceSize))
+	if err == nil || targetdata != nil {
+		t.Fatalf("Source mismatch did not fail before building output")
+	}
+}
+
+func TestSourceSizeError(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromFile(patchfile)
+
+	// A source with extra data would otherwise only fail its checksum
+	_, err := patch.PatchSourceBytes(append(sourcedata, 0))
+
+	var size_err *SourceSizeError
+	if !errors.As(err, &size_err) {
+		t.Fatalf("Oversized source did not return a SourceSizeError: %v", err)
+	}
+	if err.Error() != fmt.Sprintf("Source is %d bytes, patch expects %d", len(sourcedata)+1, patch.SourceSize) {
+		t.Fatalf("Unexpected SourceSizeError: %s", err)
+	}
+
+	// Callers checking for the wrong source by its checksum still find it
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumSource || checksum_err.Expected != patch.SourceChecksum {
+		t.Fatalf("SourceSizeError is not a source ChecksumError: %v", checksum_err)
+	}
+}
@@ -0,0 +1,110 @@
+package bps
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Apply the patch at patchPath to the file at sourcePath, writing the verified
+// target to outputPath.  The target is written to outputPath + ".tmp" with
+// ApplyFileToFile and renamed into place, so outputPath is never left half
+// written, and nothing is written there at all unless the target checksum
+// verifies.  The sizes the patch declares are limited to DefaultMaxSize, as
+// for PatchSourceFile.  Errors say which step failed.
+func ApplyFile(patchPath, sourcePath, outputPath string) error {
+	patchfile, err := os.Open(patchPath)
+	if err != nil {
+		return fmt.Errorf("Error opening patchfile: %w", err)
+	}
+	defer patchfile.Close()
+
+	patch, err := FromFile(patchfile)
+	if err != nil {
+		return fmt.Errorf("Error reading patch %s: %w", patchPath, err)
+	}
+
+	sourcefile, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("Error opening source file: %w", err)
+	}
+	defer sourcefile.Close()
+
+	var apply_err error
+	err = write_file_atomic(outputPath, func(output *os.File) error {
+		apply_err = patch.ApplyFileToFile(sourcefile, output, ApplyOptions{})
+		return apply_err
+	})
+	if apply_err != nil {
+		return fmt.Errorf("Error applying patch to %s: %w", sourcePath, apply_err)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing output: %w", err)
+	}
+
+	return nil
+}
+
+// Apply the patch to the source file src, writing the target to dst as
+// ApplyToStorage does, so that memory use stays flat however large the files
+// are.  dst must be open for reading as well as writing, as TargetCopy
+// actions read back from it, and is truncated to the target size.  Both
+// checksums are verified, the target only once it has been written, so on a
+// ChecksumError dst holds the bad target.
+//
+// opts is honored as ApplyToStorage honors it.  Nothing held in memory grows
+// with the sizes the patch declares, but a hostile patch could still fill the
+// disk, so the default limits still apply; raise them to patch anything
+// larger.
+func (patch *BPSPatch) ApplyFileToFile(src *os.File, dst *os.File, opts ApplyOptions) error {
+	err := patch.check_source_file_size(src)
+	if err != nil {
+		return err
+	}
+
+	err = patch.ApplyToStorage(src, dst, opts)
+	if err != nil && !errors.Is(err, ErrTargetMismatchIgnored) {
+		return err
+	}
+
+	truncate_err := dst.Truncate(int64(patch.TargetSize))
+	if truncate_err != nil {
+		return truncate_err
+	}
+	return err
+}
+
+// Write to path atomically: write is given path + ".tmp" in the same
+// directory, opened for reading and writing, which is synced to disk and only
+// renamed over path once write succeeds.  On any error the temporary file is
+// removed, so path only ever holds its old contents or everything write
+// produced.
+func write_file_atomic(path string, write func(output *os.File) error) (err error) {
+	temp_path := path + ".tmp"
+
+	tempfile, err := os.OpenFile(temp_path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(temp_path)
+		}
+	}()
+
+	err = write(tempfile)
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	if err != nil {
+		tempfile.Close()
+		return err
+	}
+
+	err = tempfile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp_path, path)
+}
@@ -0,0 +1,142 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyFile(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output")
+
+	if err := ApplyFile("test/testpatch.bps", "test/sourceFile", output); err != nil {
+		t.Fatalf("ApplyFile returned an error: %s", err)
+	}
+
+	expected, _ := os.ReadFile("test/targetFile")
+	actual, _ := os.ReadFile(output)
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("ApplyFile did not write the target")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("ApplyFile left %d files behind", len(entries))
+	}
+}
+
+func TestApplyFileErrors(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	cases := map[string][]string{
+		"Error opening patchfile":   {"test/missing.bps", "test/sourceFile"},
+		"Error reading patch":       {"test/sourceFile", "test/sourceFile"},
+		"Error opening source file": {"test/testpatch.bps", "test/missing"},
+		"Error applying patch":      {"test/testpatch.bps", "test/targetFile"},
+	}
+
+	for step, paths := range cases {
+		err := ApplyFile(paths[0], paths[1], output)
+		if err == nil || !strings.HasPrefix(err.Error(), step) {
+			t.Fatalf("ApplyFile(%s, %s) returned %v, expected %q", paths[0], paths[1], err, step)
+		}
+	}
+
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("ApplyFile wrote output despite failing")
+	}
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output")
+	os.WriteFile(path, []byte("old contents"), 0644)
+
+	err := write_file_atomic(path, func(output *os.File) error {
+		output.Write([]byte("half written"))
+		return errors.New("write interrupted")
+	})
+	if err == nil {
+		t.Fatalf("write_file_atomic did not return the write error")
+	}
+
+	contents, _ := os.ReadFile(path)
+	if string(contents) != "old contents" {
+		t.Fatalf("write_file_atomic replaced the file after a failed write: %q", contents)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("write_file_atomic left the temporary file behind")
+	}
+}
+
+func TestApplyFileToFile(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	sourcefile, _ := os.Open("test/sourceFile")
+	defer sourcefile.Close()
+
+	// Anything already in dst past the target is cut off
+	path := filepath.Join(t.TempDir(), "output")
+	os.WriteFile(path, bytes.Repeat([]byte("x"), len(expectedtargetdata)+100), 0644)
+	dst, _ := os.OpenFile(path, os.O_RDWR, 0)
+	defer dst.Close()
+
+	err := patch.ApplyFileToFile(sourcefile, dst, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyFileToFile returned an error: %s", err)
+	}
+
+	targetdata, _ := os.ReadFile(path)
+	if !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("ApplyFileToFile produced the wrong target")
+	}
+
+	wrong_source, _ := os.Open("test/targetFile")
+	defer wrong_source.Close()
+	if err := patch.ApplyFileToFile(wrong_source, dst, ApplyOptions{}); err == nil {
+		t.Fatalf("ApplyFileToFile accepted the wrong source")
+	}
+}
+
+func TestApplyFileSizeLimit(t *testing.T) {
+	// A tiny patch declaring a target past DefaultMaxSize, which would fill
+	// the disk if applied
+	var encoded bytes.Buffer
+	write_action(&encoded, TargetRead, 1)
+	encoded.WriteByte('x')
+	write_action(&encoded, TargetCopy, DefaultMaxSize)
+	write_relative_offset(&encoded, 0)
+	patch := craft_patch(nil, DefaultMaxSize+1, encoded.Bytes())
+
+	dir := t.TempDir()
+	patch_path := filepath.Join(dir, "huge.bps")
+	source_path := filepath.Join(dir, "source")
+	output := filepath.Join(dir, "output")
+	patch.WriteToFile(patch_path)
+	os.WriteFile(source_path, nil, 0644)
+
+	err := ApplyFile(patch_path, source_path, output)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("ApplyFile returned %v, expected ErrTooLarge", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("ApplyFile wrote output for an oversized patch")
+	}
+
+	// ApplyFileToFile applies whatever limits it is given
+	fixturefile, _ := os.Open("test/testpatch.bps")
+	fixture, _ := FromFile(fixturefile)
+	sourcefile, _ := os.Open("test/sourceFile")
+	defer sourcefile.Close()
+	dst, _ := os.Create(output)
+	defer dst.Close()
+	err = fixture.ApplyFileToFile(sourcefile, dst, ApplyOptions{MaxTargetSize: fixture.TargetSize - 1})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("ApplyFileToFile returned %v, expected ErrTooLarge", err)
+	}
+}
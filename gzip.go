@@ -0,0 +1,44 @@
+package bps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// First bytes of any gzip stream
+var gzip_magic = []byte{0x1f, 0x8b}
+
+// Read a gzip compressed BPS patch from a stream.  The stream is decompressed
+// to EOF and parsed with FromBytes, so the patch checksum is verified against
+// the decompressed patch, as it would be for an uncompressed one.
+func FromReaderGzip(r io.Reader) (patch BPSPatch, err error) {
+	data, err := gunzip(r)
+	if err != nil {
+		return
+	}
+
+	return FromBytes(data)
+}
+
+// Decompress a whole gzip stream into memory
+func gunzip(r io.Reader) ([]byte, error) {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading gzip header: %w", err)
+	}
+	defer decompressor.Close()
+
+	data, err := io.ReadAll(decompressor)
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing patch: %w", err)
+	}
+
+	return data, nil
+}
+
+// Report whether data starts with the gzip magic bytes
+func is_gzip(data []byte) bool {
+	return bytes.HasPrefix(data, gzip_magic)
+}
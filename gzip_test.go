@@ -0,0 +1,57 @@
+package bps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+)
+
+func gzipped(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+func TestFromReaderGzip(t *testing.T) {
+	expected_bps := BPSPatch{
+		SourceSize:     45,
+		TargetSize:     92,
+		MetadataSize:   0,
+		Metadata:       "",
+		SourceChecksum: 0x133070d,
+		TargetChecksum: 0x76c91265,
+		PatchChecksum:  0xc18e4db1,
+	}
+
+	data, _ := os.ReadFile("test/testpatch.bps")
+
+	bps, err := FromReaderGzip(bytes.NewReader(gzipped(data)))
+	if err != nil {
+		t.Fatalf("FromReaderGzip returned an error: %s", err)
+	}
+
+	compare_bps(&expected_bps, &bps, t)
+
+	if _, err := FromReaderGzip(bytes.NewReader(data)); err == nil {
+		t.Fatalf("FromReaderGzip accepted an uncompressed patch")
+	}
+}
+
+func TestOpenPatchGzip(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	patcher, err := OpenPatch(gzipped(data))
+	if err != nil {
+		t.Fatalf("OpenPatch returned an error for a gzipped patch: %s", err)
+	}
+
+	targetdata, err := patcher.Apply(sourcedata)
+	if err != nil || !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("Gzipped patch did not apply: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package bps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Everything about a patch except its actions: the sizes, metadata and
+// checksums from its header and footer
+type BPSHeader struct {
+	SourceSize     uint64
+	TargetSize     uint64
+	MetadataSize   uint64
+	Metadata       string
+	SourceChecksum uint32
+	TargetChecksum uint32
+	PatchChecksum  uint32
+}
+
+// Read the header and footer of the size byte patch in r, without reading the
+// actions between them.  Only the start and end of the file are read, so this
+// is cheap enough to run over a whole directory of patches.  The patch
+// checksum is returned but not verified, as that would mean reading
+// everything.
+func PeekHeader(r io.ReaderAt, size int64) (BPSHeader, error) {
+	header, _, _, err := peek_header(r, size)
+	return header, err
+}
+
+// Read the metadata of the size byte patch in r, reading only the sizes before
+// it and nothing after it.  This is much cheaper than FromFile when all that is
+// wanted is the metadata of each patch in a library.
+func ReadMetadata(r io.ReaderAt, size int64) (string, error) {
+	header, encoded_sizes, err := peek_sizes(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := read_metadata(r, size, int64(len(encoded_sizes)), header.MetadataSize)
+	return string(metadata), err
+}
+
+// Read and check the header and footer as PeekHeader does, also returning the
+// offset the actions start at and every byte before them
+func peek_header(r io.ReaderAt, size int64) (header BPSHeader, actions_offset int64, encoded_header []byte, err error) {
+	header, encoded_sizes, err := peek_sizes(r, size)
+	if err != nil {
+		return
+	}
+
+	metadata_offset := int64(len(encoded_sizes))
+	metadata, err := read_metadata(r, size, metadata_offset, header.MetadataSize)
+	if err != nil {
+		return
+	}
+	header.Metadata = string(metadata)
+	actions_offset = metadata_offset + int64(header.MetadataSize)
+
+	if size-actions_offset < FooterSize {
+		err = fmt.Errorf("Patch truncated: %d bytes after the metadata, the checksum footer alone needs %d", size-actions_offset, FooterSize)
+		return
+	}
+
+	var footer [FooterSize]byte
+	err = read_at(r, footer[:], size-FooterSize)
+	if err != nil {
+		err = fmt.Errorf("Error reading checksum footer: %w", err)
+		return
+	}
+	header.SourceChecksum = binary.LittleEndian.Uint32(footer[0:4])
+	header.TargetChecksum = binary.LittleEndian.Uint32(footer[4:8])
+	header.PatchChecksum = binary.LittleEndian.Uint32(footer[8:12])
+
+	encoded_header = append(encoded_sizes, metadata...)
+
+	return
+}
+
+// Read the magic and the three sizes from the start of the patch, returning a
+// header with only the sizes filled in, and the bytes they were read from
+func peek_sizes(r io.ReaderAt, size int64) (header BPSHeader, encoded_sizes []byte, err error) {
+	// Everything before the metadata is the magic and three numbers
+	prefix_size := int64(len(Magic) + 3*max_varint_len)
+	if prefix_size > size {
+		prefix_size = size
+	}
+	if prefix_size < 0 {
+		prefix_size = 0
+	}
+	prefix := make([]byte, prefix_size)
+	err = read_at(r, prefix, 0)
+	if err != nil {
+		err = fmt.Errorf("Error reading patch header: %w", err)
+		return
+	}
+
+	if !bytes.HasPrefix(prefix, []byte(Magic)) {
+		err = magic_error(prefix)
+		return
+	}
+
+	if size < int64(bps_min_size) {
+		err = fmt.Errorf("Patch too short: %d bytes, a valid patch is at least %d", size, bps_min_size)
+		return
+	}
+
+	remaining := prefix[len(Magic):]
+
+	header.SourceSize, remaining, err = bps_read_num(remaining)
+	if err != nil {
+		err = fmt.Errorf("Error reading source size: %w", err)
+		return
+	}
+
+	header.TargetSize, remaining, err = bps_read_num(remaining)
+	if err != nil {
+		err = fmt.Errorf("Error reading target size: %w", err)
+		return
+	}
+
+	header.MetadataSize, remaining, err = bps_read_num(remaining)
+	if err != nil {
+		err = fmt.Errorf("Error reading metadata size: %w", err)
+		return
+	}
+
+	return header, prefix[:len(prefix)-len(remaining)], nil
+}
+
+// Read the metadata_size bytes of metadata at offset, checking they fit in the
+// patch and are valid UTF-8
+func read_metadata(r io.ReaderAt, size, offset int64, metadata_size uint64) ([]byte, error) {
+	if metadata_size > uint64(size-offset) {
+		return nil, fmt.Errorf("Metadata size %d larger than the %d bytes remaining", metadata_size, size-offset)
+	}
+
+	metadata := make([]byte, metadata_size)
+	err := read_at(r, metadata, offset)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading metadata: %w", err)
+	}
+	if !utf8.Valid(metadata) {
+		return nil, errors.New("Patch metadata is not valid UTF-8")
+	}
+
+	return metadata, nil
+}
+
+// Fill buf from r starting at offset, failing if r ends first
+func read_at(r io.ReaderAt, buf []byte, offset int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(r, offset, int64(len(buf))), buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
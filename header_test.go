@@ -0,0 +1,80 @@
+package bps
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestPeekHeader(t *testing.T) {
+	for _, path := range []string{"test/testpatch.bps", "test/7f2e1606616492d7dfb589e8dfb70027.bps"} {
+		data, _ := os.ReadFile(path)
+		patch, _ := FromBytes(data)
+
+		header, err := PeekHeader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("PeekHeader returned an error for %s: %s", path, err)
+		}
+
+		expected := BPSHeader{
+			SourceSize:     patch.SourceSize,
+			TargetSize:     patch.TargetSize,
+			MetadataSize:   patch.MetadataSize,
+			Metadata:       patch.Metadata,
+			SourceChecksum: patch.SourceChecksum,
+			TargetChecksum: patch.TargetChecksum,
+			PatchChecksum:  patch.PatchChecksum,
+		}
+		if header != expected {
+			t.Fatalf("PeekHeader read %+v from %s, expected %+v", header, path, expected)
+		}
+	}
+}
+
+func TestPeekHeaderSkipsActions(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+
+	// Corrupt actions are not read, so do not matter
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(data)-13] ^= 0xff
+	if _, err := PeekHeader(bytes.NewReader(corrupt), int64(len(corrupt))); err != nil {
+		t.Fatalf("PeekHeader checked the actions: %s", err)
+	}
+
+	if _, err := PeekHeader(bytes.NewReader(data), 8); err == nil {
+		t.Fatalf("PeekHeader accepted a truncated patch")
+	}
+	if _, err := PeekHeader(bytes.NewReader([]byte("PATCH...EOF")), 11); err == nil {
+		t.Fatalf("PeekHeader accepted an IPS patch")
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	for _, metadata := range []string{"", "plain", `{"created":"2019-04-01"}`} {
+		source, target := synthetic_rom(1 << 10)
+		patch, _ := CreatePatchDelta(source, target, EncodeOptions{Metadata: metadata})
+		data, _ := patch.MarshalBinary()
+
+		read, err := ReadMetadata(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("ReadMetadata returned an error: %s", err)
+		}
+		if read != metadata {
+			t.Fatalf("ReadMetadata read %q, expected %q", read, metadata)
+		}
+	}
+}
+
+func TestReadMetadataInvalid(t *testing.T) {
+	patch := BPSPatch{Metadata: "\xff\xfe"}
+	data, _ := patch.MarshalBinary()
+	if _, err := ReadMetadata(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatalf("ReadMetadata accepted metadata which is not UTF-8")
+	}
+
+	patch = BPSPatch{Metadata: "truncated"}
+	data, _ = patch.MarshalBinary()
+	if _, err := ReadMetadata(bytes.NewReader(data), 10); err == nil {
+		t.Fatalf("ReadMetadata accepted truncated metadata")
+	}
+}
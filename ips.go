@@ -0,0 +1,132 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ips_header = []byte("PATCH")
+	ips_footer = []byte("EOF")
+)
+
+// A single IPS record: either literal data, or a run of one repeated byte
+type ips_record struct {
+	offset     int
+	data       []byte
+	rle_length int
+	rle_value  byte
+}
+
+// A parsed IPS patch
+type ips_patch struct {
+	records []ips_record
+	// Size the output is truncated to, from the optional truncation extension
+	// following the EOF marker, or -1 when there isn't one
+	truncate_size int
+}
+
+// Convert an IPS patch into an equivalent BPS patch.  IPS stores no sizes or
+// checksums, so the source the IPS patch applies to is required: it is patched
+// with the IPS records and a BPS patch is then created from source to the
+// result.
+func FromIPS(data []byte, source []byte) (*BPSPatch, error) {
+	ips, err := parse_ips(data)
+	if err != nil {
+		return nil, err
+	}
+
+	target, _ := ips.Apply(source)
+	return CreatePatchDelta(source, target, EncodeOptions{})
+}
+
+// Parse the records of an IPS patch.  Each record is a 3 byte big endian
+// offset and 2 byte length followed by that much data, or, when the length is
+// zero, a 2 byte run length and the byte to repeat.
+func parse_ips(data []byte) (*ips_patch, error) {
+	if !bytes.HasPrefix(data, ips_header) {
+		return nil, errors.New("IPS Magic Header Incorrect")
+	}
+
+	ips := &ips_patch{truncate_size: -1}
+	remaining := data[len(ips_header):]
+
+	for {
+		if len(remaining) < 3 {
+			return nil, errors.New("IPS patch ended before the EOF marker")
+		}
+		if bytes.Equal(remaining[:3], ips_footer) {
+			remaining = remaining[3:]
+			break
+		}
+		if len(remaining) < 5 {
+			return nil, errors.New("IPS record header truncated")
+		}
+
+		record := ips_record{
+			offset: int(remaining[0])<<16 | int(remaining[1])<<8 | int(remaining[2]),
+		}
+		length := int(remaining[3])<<8 | int(remaining[4])
+		remaining = remaining[5:]
+
+		if length == 0 {
+			if len(remaining) < 3 {
+				return nil, fmt.Errorf("IPS RLE record at offset %d truncated", record.offset)
+			}
+			record.rle_length = int(remaining[0])<<8 | int(remaining[1])
+			record.rle_value = remaining[2]
+			remaining = remaining[3:]
+		} else {
+			if len(remaining) < length {
+				return nil, fmt.Errorf("IPS record at offset %d truncated", record.offset)
+			}
+			record.data = remaining[:length]
+			remaining = remaining[length:]
+		}
+
+		ips.records = append(ips.records, record)
+	}
+
+	switch len(remaining) {
+	case 0:
+	case 3:
+		ips.truncate_size = int(remaining[0])<<16 | int(remaining[1])<<8 | int(remaining[2])
+	default:
+		return nil, fmt.Errorf("IPS patch has %d unexpected bytes after the EOF marker", len(remaining))
+	}
+
+	return ips, nil
+}
+
+// Apply the IPS records to a copy of source.  Records past the end of the
+// source grow the output, with any gap zero filled.  IPS has no checksums, so
+// this never fails.
+func (ips *ips_patch) Apply(source []byte) ([]byte, error) {
+	target := append([]byte{}, source...)
+
+	for _, record := range ips.records {
+		length := len(record.data)
+		if record.data == nil {
+			length = record.rle_length
+		}
+
+		if end := record.offset + length; end > len(target) {
+			target = append(target, make([]byte, end-len(target))...)
+		}
+
+		if record.data != nil {
+			copy(target[record.offset:], record.data)
+		} else {
+			for i := 0; i < record.rle_length; i++ {
+				target[record.offset+i] = record.rle_value
+			}
+		}
+	}
+
+	if ips.truncate_size >= 0 && ips.truncate_size < len(target) {
+		target = target[:ips.truncate_size]
+	}
+
+	return target, nil
+}
@@ -0,0 +1,57 @@
+package bps
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestFromIPS(t *testing.T) {
+	ipsdata, _ := os.ReadFile("test/testpatch.ips")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expected := []byte("The Snow in spain falls mainly in the plains\n!!!!!")
+
+	patch, err := FromIPS(ipsdata, sourcedata)
+	if err != nil {
+		t.Fatalf("FromIPS returned an error: %s", err)
+	}
+
+	targetdata, err := patch.PatchSourceBytes(sourcedata)
+	if err != nil {
+		t.Fatalf("Applying the converted patch returned an error: %s", err)
+	}
+
+	if !bytes.Equal(targetdata, expected) {
+		t.Fatalf("Converted patch produced %q", targetdata)
+	}
+}
+
+func TestFromIPSTruncation(t *testing.T) {
+	ipsdata := []byte("PATCH\x00\x00\x00\x00\x01XEOF\x00\x00\x03")
+
+	patch, err := FromIPS(ipsdata, []byte("abcdef"))
+	if err != nil {
+		t.Fatalf("FromIPS returned an error: %s", err)
+	}
+
+	targetdata, _ := patch.PatchSourceBytes([]byte("abcdef"))
+	if string(targetdata) != "Xbc" {
+		t.Fatalf("Truncated IPS patch produced %q", targetdata)
+	}
+}
+
+func TestFromIPSMalformed(t *testing.T) {
+	cases := map[string]string{
+		"bad magic":        "PATCX\x00\x00\x00\x00\x01XEOF",
+		"no EOF":           "PATCH\x00\x00\x00\x00\x01X",
+		"truncated record": "PATCH\x00\x00\x00\x00\x05XEOF",
+		"truncated RLE":    "PATCH\x00\x00\x00\x00\x00\x00",
+		"trailing garbage": "PATCHEOF\x00",
+	}
+
+	for name, ipsdata := range cases {
+		if _, err := FromIPS([]byte(ipsdata), []byte("abcdef")); err == nil {
+			t.Fatalf("%s: FromIPS did not return an error", name)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package bps
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The JSON form of a patch header, as produced by MarshalJSON
+type patch_json struct {
+	SourceSize     uint64 `json:"source_size"`
+	TargetSize     uint64 `json:"target_size"`
+	MetadataSize   uint64 `json:"metadata_size"`
+	Metadata       string `json:"metadata"`
+	ActionsSize    int    `json:"actions_size"`
+	SourceChecksum string `json:"source_checksum"`
+	TargetChecksum string `json:"target_checksum"`
+	PatchChecksum  string `json:"patch_checksum"`
+}
+
+// Describe the patch as JSON, for logging and inspection.  The sizes, metadata
+// and checksums (as hex strings) are included, but only the length of the
+// action stream rather than the actions themselves.
+func (patch *BPSPatch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(patch_json{
+		SourceSize:     patch.SourceSize,
+		TargetSize:     patch.TargetSize,
+		MetadataSize:   patch.MetadataSize,
+		Metadata:       patch.Metadata,
+		ActionsSize:    len(patch.Actions),
+		SourceChecksum: fmt.Sprintf("%08x", patch.SourceChecksum),
+		TargetChecksum: fmt.Sprintf("%08x", patch.TargetChecksum),
+		PatchChecksum:  fmt.Sprintf("%08x", patch.PatchChecksum),
+	})
+}
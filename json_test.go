@@ -0,0 +1,36 @@
+package bps
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	encoded, err := json.Marshal(&patch)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %s", err)
+	}
+
+	for _, expected := range []string{
+		`"source_size":45`,
+		`"target_size":92`,
+		`"source_checksum":"0133070d"`,
+		`"target_checksum":"76c91265"`,
+		`"patch_checksum":"c18e4db1"`,
+		`"actions_size":` + strconv.Itoa(len(patch.Actions)),
+	} {
+		if !strings.Contains(string(encoded), expected) {
+			t.Fatalf("JSON %s does not contain %s", encoded, expected)
+		}
+	}
+
+	if strings.Contains(string(encoded), `"actions":`) {
+		t.Fatalf("JSON included the raw actions: %s", encoded)
+	}
+}
@@ -0,0 +1,189 @@
+package bps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// A BPS patch whose actions stay in the patch file until it is applied.  Only
+// the header, metadata and checksum footer are read when it is opened; each
+// apply then streams the actions through in a single forward pass, so peak
+// memory is the source plus the target rather than the source, target and
+// patch together.
+//
+// This is only worth the extra I/O when the patch is large next to the files
+// it patches, typically one made mostly of TargetReads, and memory is tight.
+// For anything else open the patch with FromFile, which reads it once and
+// can then be applied any number of times without touching the file again.
+//
+// The patch checksum is verified as the actions are streamed, so, unlike
+// FromFile, a corrupt patch is only caught once it has been applied.  The
+// underlying file must not change while the LazyPatch is in use.
+type LazyPatch struct {
+	BPSHeader
+
+	r              io.ReaderAt
+	actions_offset int64
+	actions_size   int64
+	// Everything before the actions, and the two checksums after them, to
+	// verify the patch checksum against once the actions are streamed
+	encoded_header []byte
+	footer         [8]byte
+}
+
+// Open the size byte patch in r for applying lazily.  The header and footer
+// are checked as FromBytes checks them, except for the patch checksum, which
+// is checked on every apply.
+func OpenLazyPatch(r io.ReaderAt, size int64) (*LazyPatch, error) {
+	header, actions_offset, encoded_header, err := peek_header(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := &LazyPatch{
+		BPSHeader:      header,
+		r:              r,
+		actions_offset: actions_offset,
+		actions_size:   size - actions_offset - FooterSize,
+		encoded_header: encoded_header,
+	}
+	binary.LittleEndian.PutUint32(patch.footer[0:4], header.SourceChecksum)
+	binary.LittleEndian.PutUint32(patch.footer[4:8], header.TargetChecksum)
+
+	return patch, nil
+}
+
+// Apply the patch to source data already held in memory, as
+// BPSPatch.PatchSourceBytes does, reading the actions from the patch file as
+// they are applied
+func (patch *LazyPatch) PatchSourceBytes(source_data []byte) (target_data []byte, err error) {
+	return patch.ApplyWithOptions(source_data, ApplyOptions{})
+}
+
+// Apply the patch to source data already held in memory, as
+// BPSPatch.ApplyWithOptions does, reading the actions from the patch file as
+// they are applied.  The patch checksum is verified regardless of opts.
+func (patch *LazyPatch) ApplyWithOptions(source_data []byte, opts ApplyOptions) (target_data []byte, err error) {
+	header := patch.header()
+	defer func() { opts.log_apply(&header, err) }()
+
+	err = opts.check_sizes(&header)
+	if err != nil {
+		return
+	}
+
+	if !opts.SkipSourceChecksum {
+		err = header.check_source_size(uint64(len(source_data)))
+		if err != nil {
+			return
+		}
+
+		source_checksum := opts.new_hash()
+		source_checksum.Write(source_data)
+		calculated_source_checksum := source_checksum.Sum32()
+		if calculated_source_checksum != patch.SourceChecksum {
+			return nil, &ChecksumError{Kind: ChecksumSource, Expected: patch.SourceChecksum, Actual: calculated_source_checksum}
+		}
+	}
+
+	actions := &reader_actions{
+		r:        bufio.NewReader(io.NewSectionReader(patch.r, patch.actions_offset, patch.actions_size)),
+		left:     uint64(patch.actions_size),
+		checksum: opts.new_hash(),
+	}
+	actions.checksum.Write(patch.encoded_header)
+	target_data, err = header.apply(context.Background(), bytes.NewReader(source_data), actions, nil, opts)
+
+	// Only once every action has been read is the patch checksum known.  A
+	// corrupt patch explains any other failure, so it is reported first.
+	if actions.left == 0 && actions.err == nil {
+		actions.checksum.Write(patch.footer[:])
+		calculated_patch_checksum := actions.checksum.Sum32()
+		if calculated_patch_checksum != patch.PatchChecksum {
+			return nil, &ChecksumError{Kind: ChecksumPatch, Expected: patch.PatchChecksum, Actual: calculated_patch_checksum}
+		}
+	}
+
+	return
+}
+
+// The patch without its actions, for the apply engine to run the streamed
+// actions against
+func (patch *LazyPatch) header() BPSPatch {
+	return BPSPatch{
+		SourceSize:     patch.SourceSize,
+		TargetSize:     patch.TargetSize,
+		MetadataSize:   patch.MetadataSize,
+		Metadata:       patch.Metadata,
+		SourceChecksum: patch.SourceChecksum,
+		TargetChecksum: patch.TargetChecksum,
+		PatchChecksum:  patch.PatchChecksum,
+	}
+}
+
+// An action_stream reading the actions of a patch file as they are applied,
+// calculating the patch checksum over them on the way.  A TargetRead payload
+// is read into a buffer reused by the next one.
+type reader_actions struct {
+	r        *bufio.Reader
+	left     uint64
+	checksum hash.Hash32
+	num      [max_varint_len]byte
+	payload  []byte
+	// The first read error, after which the checksum is incomplete
+	err error
+}
+
+func (actions *reader_actions) remaining() uint64 {
+	return actions.left
+}
+
+// Read a variable length number a byte at a time, stopping at its final byte
+// or once it is too long for bps_read_num to accept
+func (actions *reader_actions) read_num() (uint64, error) {
+	length := 0
+	for length < max_varint_len && actions.left > 0 {
+		b, err := actions.r.ReadByte()
+		if err != nil {
+			return 0, actions.fail(err)
+		}
+		actions.num[length] = b
+		length++
+		actions.left--
+		if b&0x80 == 0x80 {
+			break
+		}
+	}
+	actions.checksum.Write(actions.num[:length])
+
+	data, _, err := bps_read_num(actions.num[:length])
+	return data, err
+}
+
+func (actions *reader_actions) read_payload(length uint64) ([]byte, error) {
+	if uint64(cap(actions.payload)) < length {
+		actions.payload = make([]byte, length)
+	}
+	payload := actions.payload[:length]
+
+	_, err := io.ReadFull(actions.r, payload)
+	if err != nil {
+		return nil, actions.fail(err)
+	}
+	actions.left -= length
+	actions.checksum.Write(payload)
+
+	return payload, nil
+}
+
+func (actions *reader_actions) fail(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	actions.err = err
+	return err
+}
@@ -0,0 +1,130 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestLazyPatchFixture(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	lazy, err := OpenLazyPatch(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenLazyPatch returned an error: %s", err)
+	}
+
+	patch, _ := FromBytes(data)
+	header := lazy.header()
+	patch.Actions = nil
+	if !header.Equal(&patch) {
+		t.Fatalf("LazyPatch header %+v does not match FromBytes %+v", header, patch)
+	}
+
+	targetdata, err := lazy.PatchSourceBytes(sourcedata)
+	if err != nil {
+		t.Fatalf("PatchSourceBytes returned an error: %s", err)
+	}
+	if !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("LazyPatch produced the wrong target")
+	}
+
+	// Applying again streams the actions again
+	targetdata, err = lazy.PatchSourceBytes(sourcedata)
+	if err != nil || !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("Second apply of a LazyPatch failed: %v", err)
+	}
+}
+
+func TestLazyPatchDelta(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{Metadata: "lazy"})
+	data, _ := patch.MarshalBinary()
+
+	lazy, err := OpenLazyPatch(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenLazyPatch returned an error: %s", err)
+	}
+	if lazy.Metadata != "lazy" {
+		t.Fatalf("LazyPatch metadata %q, expected %q", lazy.Metadata, "lazy")
+	}
+
+	targetdata, err := lazy.PatchSourceBytes(source)
+	if err != nil {
+		t.Fatalf("PatchSourceBytes returned an error: %s", err)
+	}
+	if !bytes.Equal(targetdata, target) {
+		t.Fatalf("LazyPatch produced the wrong target")
+	}
+}
+
+func TestLazyPatchCorruptActions(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromBytes(data)
+
+	// Flip a bit inside a TargetRead payload, which still applies, but
+	// produces the wrong target and fails the patch checksum
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(data)-12-1] ^= 0x01
+
+	lazy, err := OpenLazyPatch(bytes.NewReader(corrupt), int64(len(corrupt)))
+	if err != nil {
+		t.Fatalf("OpenLazyPatch checked the actions: %s", err)
+	}
+
+	_, err = lazy.PatchSourceBytes(sourcedata)
+	var checksum_err *ChecksumError
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumPatch {
+		t.Fatalf("Corrupt actions returned %v, expected a patch checksum error", err)
+	}
+	if checksum_err.Expected != patch.PatchChecksum {
+		t.Fatalf("Patch checksum error expected %08x, patch has %08x", checksum_err.Expected, patch.PatchChecksum)
+	}
+}
+
+func TestLazyPatchTruncated(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+
+	for _, size := range []int{0, 3, bps_min_size - 1, 6} {
+		_, err := OpenLazyPatch(bytes.NewReader(data), int64(size))
+		if err == nil {
+			t.Fatalf("OpenLazyPatch accepted a patch truncated to %d bytes", size)
+		}
+	}
+
+	// Cutting into the actions leaves a footer to read, so is only caught by
+	// applying
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	lazy, err := OpenLazyPatch(bytes.NewReader(data), int64(len(data)-13))
+	if err == nil {
+		if _, err := lazy.PatchSourceBytes(sourcedata); err == nil {
+			t.Fatalf("LazyPatch applied a patch with truncated actions")
+		}
+	}
+
+	if _, err := OpenLazyPatch(bytes.NewReader([]byte("PATCH...EOF")), 11); err == nil {
+		t.Fatalf("OpenLazyPatch accepted an IPS patch")
+	}
+}
+
+func TestLazyPatchShortActions(t *testing.T) {
+	source := []byte("01234567")
+	var encoded bytes.Buffer
+	write_action(&encoded, SourceRead, 4)
+	write_action(&encoded, TargetRead, 4)
+	encoded.Write([]byte("ab"))
+
+	data, _ := craft_patch(source, 8, encoded.Bytes()).MarshalBinary()
+	lazy, err := OpenLazyPatch(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenLazyPatch returned an error: %s", err)
+	}
+
+	if _, err := lazy.PatchSourceBytes(source); err == nil {
+		t.Fatalf("LazyPatch applied actions with a truncated TargetRead")
+	}
+}
@@ -0,0 +1,61 @@
+package bps
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Unmarshal the patch metadata as JSON into v.  ALTTPR base patches, for
+// example, carry metadata like {"created":"2021-09-18","hash":"..."}.
+func (patch *BPSPatch) MetadataJSON(v interface{}) error {
+	if patch.Metadata == "" {
+		return errors.New("Patch has no metadata")
+	}
+
+	err := json.Unmarshal([]byte(patch.Metadata), v)
+	if err != nil {
+		return fmt.Errorf("Patch metadata is not valid JSON: %w", err)
+	}
+
+	return nil
+}
+
+// Replace the patch metadata, keeping MetadataSize in step.  The spec requires
+// metadata to be UTF-8, so anything else is rejected.  PatchChecksum is left
+// alone until the patch is next serialized, which recalculates it.
+func (patch *BPSPatch) SetMetadata(metadata string) error {
+	if !utf8.ValidString(metadata) {
+		return errors.New("Patch metadata must be valid UTF-8")
+	}
+
+	patch.Metadata = metadata
+	patch.MetadataSize = uint64(len(metadata))
+
+	return nil
+}
+
+// Check target against the MD5 hash carried in the metadata of ALTTPR style
+// patches, as the "hash" field of a JSON object.  This catches a target whose
+// CRC32 happens to match but is still the wrong file.  Patches without such a
+// hash, including those whose metadata isn't JSON at all, always pass.
+func (patch *BPSPatch) VerifyMetadataHash(target []byte) error {
+	var metadata struct {
+		Hash string `json:"hash"`
+	}
+	if json.Unmarshal([]byte(patch.Metadata), &metadata) != nil || metadata.Hash == "" {
+		return nil
+	}
+
+	target_hash := md5.Sum(target)
+	calculated_hash := hex.EncodeToString(target_hash[:])
+	if !strings.EqualFold(calculated_hash, metadata.Hash) {
+		return fmt.Errorf("Target MD5 %s does not match metadata hash %s", calculated_hash, metadata.Hash)
+	}
+
+	return nil
+}
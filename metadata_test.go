@@ -0,0 +1,130 @@
+package bps
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMetadataJSON(t *testing.T) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	patch, err := FromFile(patchfile)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var metadata struct {
+		Created string `json:"created"`
+		Hash    string `json:"hash"`
+	}
+
+	if err := patch.MetadataJSON(&metadata); err != nil {
+		t.Fatalf("MetadataJSON returned an error: %s", err)
+	}
+
+	if metadata.Created != "2021-09-18" || metadata.Hash != "7f2e1606616492d7dfb589e8dfb70027" {
+		t.Fatalf("MetadataJSON parsed unexpected metadata: %+v", metadata)
+	}
+}
+
+func TestMetadataJSONErrors(t *testing.T) {
+	var v map[string]interface{}
+
+	empty := BPSPatch{}
+	if err := empty.MetadataJSON(&v); err == nil {
+		t.Fatalf("MetadataJSON did not reject empty metadata")
+	}
+
+	not_json := BPSPatch{Metadata: "<xml/>"}
+	if err := not_json.MetadataJSON(&v); err == nil {
+		t.Fatalf("MetadataJSON did not reject non JSON metadata")
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	if err := patch.SetMetadata(`{"edited":true}`); err != nil {
+		t.Fatalf("SetMetadata returned an error: %s", err)
+	}
+
+	serialized, _ := patch.MarshalBinary()
+	reread, err := FromBytes(serialized)
+	if err != nil {
+		t.Fatalf("Patch with new metadata did not verify: %s", err)
+	}
+
+	if reread.Metadata != `{"edited":true}` || reread.MetadataSize != 15 {
+		t.Fatalf("Metadata did not survive serialization: %q (%d)", reread.Metadata, reread.MetadataSize)
+	}
+
+	if reread.PatchChecksum == 0xc18e4db1 {
+		t.Fatalf("Patch checksum was not recalculated")
+	}
+}
+
+func TestSetMetadataInvalidUTF8(t *testing.T) {
+	patch := BPSPatch{}
+
+	if err := patch.SetMetadata("\xff\xfe"); err == nil {
+		t.Fatalf("SetMetadata accepted invalid UTF-8")
+	}
+}
+
+func TestFromBytesRejectsInvalidMetadata(t *testing.T) {
+	patch, _ := CreatePatch([]byte("source"), []byte("target"), "")
+	patch.Metadata = "bad \xff\xfe metadata"
+	patch.MetadataSize = uint64(len(patch.Metadata))
+	serialized, _ := patch.MarshalBinary()
+
+	if _, err := FromBytes(serialized); err == nil {
+		t.Fatalf("FromBytes accepted metadata which is not UTF-8")
+	}
+
+	parsed, err := FromBytesOpts(serialized, ReadOptions{AllowInvalidMetadata: true})
+	if err != nil || parsed.Metadata != patch.Metadata {
+		t.Fatalf("AllowInvalidMetadata did not accept the metadata: %v", err)
+	}
+}
+
+func TestVerifyMetadataHash(t *testing.T) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	patch, _ := FromFile(patchfile)
+
+	if err := patch.VerifyMetadataHash([]byte("not the patched rom")); err == nil {
+		t.Fatalf("VerifyMetadataHash accepted the wrong target")
+	}
+
+	// The hash of "target"
+	patch.SetMetadata(`{"hash":"42AEFBAE01D2DFD981F7DA7D823D689E"}`)
+	if err := patch.VerifyMetadataHash([]byte("target")); err != nil {
+		t.Fatalf("VerifyMetadataHash rejected a matching target: %s", err)
+	}
+
+	for _, metadata := range []string{"", "free text", `{"created":"2021-09-18"}`} {
+		patch.SetMetadata(metadata)
+		if err := patch.VerifyMetadataHash([]byte("anything")); err != nil {
+			t.Fatalf("VerifyMetadataHash failed metadata %q without a hash: %s", metadata, err)
+		}
+	}
+}
+
+func TestVerifyMetadataHashALTTPR(t *testing.T) {
+	sourcefile, err := os.Open("test/Zelda.sfc")
+	if err != nil {
+		t.Skipf("Could not read test/Zelda.sfc.  Skipping this test")
+	}
+	defer sourcefile.Close()
+
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	patch, _ := FromFile(patchfile)
+
+	target, err := patch.PatchSourceFile(sourcefile)
+	if err != nil {
+		t.Fatalf("PatchSourceFile returned an error: %s", err)
+	}
+
+	if err := patch.VerifyMetadataHash(target); err != nil {
+		t.Fatalf("VerifyMetadataHash rejected the ALTTPR base rom: %s", err)
+	}
+}
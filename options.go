@@ -0,0 +1,217 @@
+package bps
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"log/slog"
+	"math"
+)
+
+// Default limit on the source and target sizes a patch may declare before it is
+// applied.  Sizes come straight from the patch, so without a limit a hostile
+// patch could have us allocate an arbitrary amount of memory.
+const DefaultMaxSize = 256 << 20
+
+// Returned, wrapped, when a patch declares a source or target larger than the
+// configured maximum
+var ErrTooLarge = errors.New("Patch exceeds the maximum allowed size")
+
+// Returned, wrapped, when a patch or a size it declares cannot be indexed by an
+// int, which is only 32 bits wide on some platforms
+var ErrPlatformTooLarge = errors.New("Patch too large for this platform")
+
+// Returned, wrapping the target ChecksumError, when the target checksum fails
+// but ContinueOnTargetMismatch is set.  The target produced is returned or
+// written alongside it as if the checksum had matched.
+var ErrTargetMismatchIgnored = errors.New("Target checksum mismatch ignored")
+
+// Options controlling how a patch is applied.  The zero value applies the
+// defaults used by PatchSourceFile and PatchSourceBytes.
+type ApplyOptions struct {
+	// Largest SourceSize a patch may declare.  Zero selects DefaultMaxSize
+	MaxSourceSize uint64
+
+	// Largest TargetSize a patch may declare.  Zero selects DefaultMaxSize
+	MaxTargetSize uint64
+
+	// Skip verifying the source and target checksums.  This saves a pass over
+	// each file, but is only safe for patches and sources that are already
+	// trusted: an unverified source silently produces a wrong target, and
+	// nothing catches a patch that produces the wrong output.
+	SkipSourceChecksum bool
+	SkipTargetChecksum bool
+
+	// Still verify the target checksum, but treat a mismatch as a warning:
+	// the target produced is delivered as usual, and the ChecksumError is
+	// returned wrapped in ErrTargetMismatchIgnored, which errors.Is finds.
+	// Meant for debugging an encoder, where the wrong target is wanted for
+	// comparison.  A source checksum mismatch is still an error.
+	ContinueOnTargetMismatch bool
+
+	// Grow the target as the actions produce it instead of allocating
+	// TargetSize bytes up front, checking the final length against
+	// TargetSize once every action has been applied.  Writes are bounded by
+	// MaxTargetSize rather than TargetSize, so a patch whose actions disagree
+	// with its header fails with the size it actually produced.  This is
+	// slower, so is best kept for untrusted patches.
+	GrowTarget bool
+
+	// Called after each action has been applied, with the action kind, the
+	// target offset the action started writing at and the number of bytes it
+	// wrote.  Useful for progress reporting as a fraction of TargetSize, or
+	// for tracing.
+	OnAction func(kind int, outputOffset, length uint64)
+
+	// Called by ApplyToStorage and ResumeApply each time another window of
+	// the target has been written to storage, with a Checkpoint to resume
+	// from should the apply be interrupted.  Sync the storage before saving
+	// the checkpoint, as it is only good for as much of the target as
+	// survives.  Returning an error stops the apply with that error.
+	OnCheckpoint func(Checkpoint) error
+
+	// Creates the hash the source and target checksums are calculated with,
+	// for formats derived from BPS which replace CRC32.  A LazyPatch uses it
+	// for the patch checksum too.  Nil selects crc32.NewIEEE, which is what
+	// every BPS patch uses.
+	NewHash func() hash.Hash32
+
+	// Logs a debug event once the patch has been applied, or has failed to.
+	// Nil logs nothing.
+	Logger *slog.Logger
+
+	// Called after each action has been applied by apply, with the action
+	// as the walker resolved it, for ApplyTrace
+	on_applied func(action *resolved_action)
+}
+
+// Confirm the patch's declared sizes are within the configured limits, before
+// anything is allocated based on them
+func (opts ApplyOptions) check_sizes(patch *BPSPatch) error {
+	max_source_size := opts.max_source_size()
+	max_target_size := opts.max_target_size()
+
+	if patch.SourceSize > max_source_size {
+		return fmt.Errorf("Source size %d larger than %d: %w", patch.SourceSize, max_source_size, ErrTooLarge)
+	}
+	if patch.TargetSize > max_target_size {
+		return fmt.Errorf("Target size %d larger than %d: %w", patch.TargetSize, max_target_size, ErrTooLarge)
+	}
+
+	// Only reachable when the limits are raised past what an int can hold,
+	// but then make would silently truncate the size
+	if patch.SourceSize > math.MaxInt {
+		return fmt.Errorf("Source size %d: %w", patch.SourceSize, ErrPlatformTooLarge)
+	}
+	if patch.TargetSize > math.MaxInt {
+		return fmt.Errorf("Target size %d: %w", patch.TargetSize, ErrPlatformTooLarge)
+	}
+
+	return nil
+}
+
+func (opts ApplyOptions) max_source_size() uint64 {
+	if opts.MaxSourceSize == 0 {
+		return DefaultMaxSize
+	}
+	return opts.MaxSourceSize
+}
+
+func (opts ApplyOptions) max_target_size() uint64 {
+	if opts.MaxTargetSize == 0 {
+		return DefaultMaxSize
+	}
+	return opts.MaxTargetSize
+}
+
+func (opts ApplyOptions) new_hash() hash.Hash32 {
+	return new_hash(opts.NewHash)
+}
+
+// Compare the calculated target checksum against the patch, returning a
+// ChecksumError for a mismatch, wrapped in ErrTargetMismatchIgnored if opts
+// continues past it
+func (opts ApplyOptions) check_target_checksum(patch *BPSPatch, calculated uint32) error {
+	if calculated == patch.TargetChecksum {
+		return nil
+	}
+
+	err := &ChecksumError{Kind: ChecksumTarget, Expected: patch.TargetChecksum, Actual: calculated}
+	if opts.ContinueOnTargetMismatch {
+		return fmt.Errorf("%w: %w", ErrTargetMismatchIgnored, err)
+	}
+	return err
+}
+
+// Log the outcome of applying patch, if there is a logger to log it to
+func (opts ApplyOptions) log_apply(patch *BPSPatch, err error) {
+	if opts.Logger == nil {
+		return
+	}
+	if errors.Is(err, ErrTargetMismatchIgnored) {
+		opts.Logger.Warn("Applied patch despite target checksum mismatch", "source_size", patch.SourceSize, "target_size", patch.TargetSize, "error", err)
+		return
+	}
+	if err != nil {
+		opts.Logger.Debug("Patch failed to apply", "source_size", patch.SourceSize, "target_size", patch.TargetSize, "error", err)
+		return
+	}
+	opts.Logger.Debug("Applied patch", "source_size", patch.SourceSize, "target_size", patch.TargetSize,
+		"source_checksum_verified", !opts.SkipSourceChecksum, "target_checksum_verified", !opts.SkipTargetChecksum)
+}
+
+// Options controlling how a patch is parsed.  The zero value parses as
+// FromBytes does.
+type ReadOptions struct {
+	// Copy the action stream into its own allocation.  By default Actions
+	// shares the backing array of the data being parsed, which avoids a copy
+	// but keeps the whole patch file alive for as long as the BPSPatch is,
+	// footer and all.  Set this when caching parsed patches long term.
+	// Metadata is always a string, so never shares memory with the input.
+	CopyActions bool
+
+	// Accept metadata which is not valid UTF-8.  The spec requires UTF-8, so
+	// anything else usually means a corrupt or misparsed patch, but some
+	// patchers in the wild have written other encodings.
+	AllowInvalidMetadata bool
+
+	// Skip recalculating the patch checksum.  PatchChecksum is still read
+	// from the footer, but a corrupt patch is not caught until it is applied,
+	// if then, so only set this for patches which are already trusted.
+	SkipPatchChecksum bool
+
+	// Creates the hash the patch checksum is calculated with, as
+	// ApplyOptions.NewHash does for the source and target.  Nil selects
+	// crc32.NewIEEE.
+	NewHash func() hash.Hash32
+
+	// Logs a debug event once the patch has been parsed, or has failed to.
+	// Nil logs nothing.
+	Logger *slog.Logger
+}
+
+func (opts ReadOptions) new_hash() hash.Hash32 {
+	return new_hash(opts.NewHash)
+}
+
+// Log the outcome of parsing a patch, if there is a logger to log it to
+func (opts ReadOptions) log_read(patch *BPSPatch, err error) {
+	if opts.Logger == nil {
+		return
+	}
+	if err != nil {
+		opts.Logger.Debug("Patch failed to parse", "error", err)
+		return
+	}
+	opts.Logger.Debug("Parsed patch", "source_size", patch.SourceSize, "target_size", patch.TargetSize,
+		"metadata_size", patch.MetadataSize, "actions_size", len(patch.Actions), "patch_checksum_verified", !opts.SkipPatchChecksum)
+}
+
+// Create a hash with factory, or the CRC32 the BPS format uses if it is nil
+func new_hash(factory func() hash.Hash32) hash.Hash32 {
+	if factory == nil {
+		return crc32.NewIEEE()
+	}
+	return factory()
+}
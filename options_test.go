@@ -0,0 +1,268 @@
+package bps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestApplyRejectsHugeTarget(t *testing.T) {
+	source := []byte("source")
+	patch := craft_patch(source, 100<<30, nil)
+
+	_, err := patch.PatchSourceBytes(source)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("PatchSourceBytes did not reject a 100GB target: %v", err)
+	}
+}
+
+func TestApplyRejectsHugeSource(t *testing.T) {
+	patch := craft_patch(nil, 0, nil)
+	patch.SourceSize = 100 << 30
+
+	sourcefile, _ := os.Open("test/sourceFile")
+	defer sourcefile.Close()
+
+	_, err := patch.PatchSourceFile(sourcefile)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("PatchSourceFile did not reject a 100GB source: %v", err)
+	}
+}
+
+func TestApplyWithOptionsMaxTargetSize(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromFile(patchfile)
+
+	_, err := patch.ApplyWithOptions(sourcedata, ApplyOptions{MaxTargetSize: patch.TargetSize - 1})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("ApplyWithOptions did not enforce MaxTargetSize: %v", err)
+	}
+
+	_, err = patch.ApplyWithOptions(sourcedata, ApplyOptions{MaxTargetSize: patch.TargetSize})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions rejected a target at exactly MaxTargetSize: %s", err)
+	}
+}
+
+func TestApplyWithOptionsSkipChecksums(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromFile(patchfile)
+
+	patch.SourceChecksum ^= 1
+	patch.TargetChecksum ^= 1
+
+	if _, err := patch.ApplyWithOptions(sourcedata, ApplyOptions{}); err == nil {
+		t.Fatalf("ApplyWithOptions verified bad checksums by default")
+	}
+
+	if _, err := patch.ApplyWithOptions(sourcedata, ApplyOptions{SkipSourceChecksum: true}); err == nil {
+		t.Fatalf("ApplyWithOptions skipped the target checksum too")
+	}
+
+	_, err := patch.ApplyWithOptions(sourcedata, ApplyOptions{SkipSourceChecksum: true, SkipTargetChecksum: true})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions verified skipped checksums: %s", err)
+	}
+}
+
+func TestApplyWithOptionsOnAction(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	patch, _ := FromFile(patchfile)
+
+	var (
+		calls    int
+		expected uint64
+	)
+	opts := ApplyOptions{
+		OnAction: func(kind int, outputOffset, length uint64) {
+			if outputOffset != expected {
+				t.Fatalf("OnAction saw offset %d, expected %d", outputOffset, expected)
+			}
+			expected += length
+			calls++
+		},
+	}
+
+	if _, err := patch.ApplyWithOptions(sourcedata, opts); err != nil {
+		t.Fatalf("ApplyWithOptions returned an error: %s", err)
+	}
+
+	stats, _ := patch.Stats()
+	if calls != stats.Actions || expected != patch.TargetSize {
+		t.Fatalf("OnAction called %d times covering %d bytes", calls, expected)
+	}
+}
+
+func TestApplyWithOptionsGrowTarget(t *testing.T) {
+	source, target := synthetic_rom(1 << 16)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	targetdata, err := patch.ApplyWithOptions(source, ApplyOptions{GrowTarget: true})
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("ApplyWithOptions with GrowTarget did not apply the patch: %v", err)
+	}
+
+	// A TargetSize smaller than the actions produce is reported with the
+	// real output size rather than as an out of bounds action
+	patch.TargetSize = 100
+	_, err = patch.ApplyWithOptions(source, ApplyOptions{GrowTarget: true})
+	expected := fmt.Sprintf("Patch produced %d bytes, expected 100", len(target))
+	if err == nil || err.Error() != expected {
+		t.Fatalf("GrowTarget reported %v, expected %q", err, expected)
+	}
+
+	// Growth is still bounded by MaxTargetSize
+	_, err = patch.ApplyWithOptions(source, ApplyOptions{GrowTarget: true, MaxTargetSize: 1000})
+	if err == nil || !strings.Contains(err.Error(), "out of bounds") {
+		t.Fatalf("GrowTarget grew past MaxTargetSize: %v", err)
+	}
+}
+
+func TestApplyRejectsSizesBeyondInt(t *testing.T) {
+	source := []byte("source")
+	patch := craft_patch(source, uint64(math.MaxInt)+1, nil)
+
+	_, err := patch.ApplyWithOptions(source, ApplyOptions{MaxTargetSize: math.MaxUint64})
+	if !errors.Is(err, ErrPlatformTooLarge) {
+		t.Fatalf("ApplyWithOptions accepted a target larger than an int: %v", err)
+	}
+}
+
+func TestCustomHash(t *testing.T) {
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+	new_hash := func() hash.Hash32 { return crc32.New(castagnoli) }
+
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+	patch.SourceChecksum = crc32.Checksum(source, castagnoli)
+	patch.TargetChecksum = crc32.Checksum(target, castagnoli)
+
+	data, _ := patch.MarshalBinary()
+	binary.LittleEndian.PutUint32(data[len(data)-4:], crc32.Checksum(data[:len(data)-4], castagnoli))
+
+	if _, err := FromBytes(data); err == nil {
+		t.Fatalf("FromBytes accepted a patch checksum which is not CRC32/IEEE")
+	}
+	parsed, err := FromBytesOpts(data, ReadOptions{NewHash: new_hash})
+	if err != nil {
+		t.Fatalf("FromBytesOpts rejected the custom patch checksum: %s", err)
+	}
+
+	if _, err := parsed.PatchSourceBytes(source); err == nil {
+		t.Fatalf("PatchSourceBytes accepted a source checksum which is not CRC32/IEEE")
+	}
+	targetdata, err := parsed.ApplyWithOptions(source, ApplyOptions{NewHash: new_hash})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions rejected the custom checksums: %s", err)
+	}
+	if !bytes.Equal(targetdata, target) {
+		t.Fatalf("ApplyWithOptions produced the wrong target")
+	}
+
+	lazy, _ := OpenLazyPatch(bytes.NewReader(data), int64(len(data)))
+	targetdata, err = lazy.ApplyWithOptions(source, ApplyOptions{NewHash: new_hash})
+	if err != nil || !bytes.Equal(targetdata, target) {
+		t.Fatalf("LazyPatch rejected the custom checksums: %v", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	data, _ := os.ReadFile("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+
+	patch, err := FromReaderOpts(bytes.NewReader(data), ReadOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("FromReaderOpts returned an error: %s", err)
+	}
+	_, err = patch.ApplyWithOptions(sourcedata, ApplyOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions returned an error: %s", err)
+	}
+	patch.ApplyWithOptions(sourcedata[1:], ApplyOptions{Logger: logger})
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected one event per operation, logged:\n%s", logs.String())
+	}
+	for i, expected := range []string{
+		fmt.Sprintf(`msg="Parsed patch" source_size=%d target_size=%d`, patch.SourceSize, patch.TargetSize),
+		`msg="Applied patch"`,
+		`msg="Patch failed to apply"`,
+	} {
+		if !strings.Contains(lines[i], expected) {
+			t.Fatalf("Event %d is %q, expected it to contain %q", i, lines[i], expected)
+		}
+	}
+}
+
+func TestContinueOnTargetMismatch(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+	patch.TargetChecksum ^= 1
+
+	// The mismatch is returned as a warning the caller can tell apart, with
+	// the target delivered
+	opts := ApplyOptions{ContinueOnTargetMismatch: true, Logger: logger}
+	targetdata, err := patch.ApplyWithOptions(sourcedata, opts)
+	var checksum_err *ChecksumError
+	if !errors.Is(err, ErrTargetMismatchIgnored) || !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumTarget {
+		t.Fatalf("ApplyWithOptions returned %v, expected an ignored target mismatch", err)
+	}
+	if !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("ApplyWithOptions did not return the mismatched target")
+	}
+	if !strings.Contains(logs.String(), `level=WARN msg="Applied patch despite target checksum mismatch"`) {
+		t.Fatalf("Mismatch was not logged as a warning, logged:\n%s", logs.String())
+	}
+
+	var storage memory_storage
+	err = patch.ApplyToStorage(bytes.NewReader(sourcedata), &storage, opts)
+	if !errors.Is(err, ErrTargetMismatchIgnored) || !bytes.Equal(storage.data, expectedtargetdata) {
+		t.Fatalf("ApplyToStorage returned %v, expected an ignored target mismatch", err)
+	}
+
+	tempfile, err := patch.ApplyToTempFile(bytes.NewReader(sourcedata), t.TempDir(), opts)
+	if !errors.Is(err, ErrTargetMismatchIgnored) || tempfile == nil {
+		t.Fatalf("ApplyToTempFile returned %v, expected the file and an ignored target mismatch", err)
+	}
+	tempfile.Close()
+
+	// A matching target is no error at all
+	patch.TargetChecksum ^= 1
+	if _, err := patch.ApplyWithOptions(sourcedata, opts); err != nil {
+		t.Fatalf("ApplyWithOptions of a good patch returned %v", err)
+	}
+	patch.TargetChecksum ^= 1
+
+	// Without the option the mismatch is a plain error, and a source
+	// mismatch always is
+	_, err = patch.ApplyWithOptions(sourcedata, ApplyOptions{})
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumTarget || errors.Is(err, ErrTargetMismatchIgnored) {
+		t.Fatalf("Target mismatch returned %v, expected a target checksum error", err)
+	}
+	corruptsource := append([]byte(nil), sourcedata...)
+	corruptsource[0] ^= 1
+	_, err = patch.ApplyWithOptions(corruptsource, opts)
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumSource || errors.Is(err, ErrTargetMismatchIgnored) {
+		t.Fatalf("Source mismatch returned %v, expected a source checksum error", err)
+	}
+}
@@ -0,0 +1,82 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Magic bytes of patch formats which are commonly mistaken for BPS, used to
+// explain why FromBytes rejected a file
+var foreign_formats = []struct {
+	name  string
+	magic []byte
+}{
+	{"IPS", ips_header},
+	{"UPS", ups_header},
+	{"APS", []byte("APS1")},
+	{"PPF", []byte("PPF")},
+	{"xdelta", []byte{0xd6, 0xc3, 0xc4}},
+	{"gzip compressed", gzip_magic},
+}
+
+// Anything which can turn a source file into a target file.  OpenPatch returns
+// a Patcher for each supported patch format, so callers don't need to care
+// which format they were given.
+type Patcher interface {
+	Apply(source []byte) (target []byte, err error)
+}
+
+// Apply the patch to source, as PatchSourceBytes does, satisfying Patcher
+func (patch *BPSPatch) Apply(source []byte) ([]byte, error) {
+	return patch.PatchSourceBytes(source)
+}
+
+// Parse the BPS patch in patch and apply it to source, for when the parsed
+// BPSPatch itself isn't needed
+func Apply(patch, source []byte) ([]byte, error) {
+	parsed, err := FromBytes(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed.PatchSourceBytes(source)
+}
+
+// Parse a BPS, UPS or IPS patch, picking the format from the magic bytes at
+// the start of data.  Gzip compressed patches are decompressed first.
+func OpenPatch(data []byte) (Patcher, error) {
+	if is_gzip(data) {
+		decompressed, err := gunzip(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data = decompressed
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte(Magic)):
+		patch, err := FromBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		return &patch, nil
+	case bytes.HasPrefix(data, ups_header):
+		return FromUPS(data)
+	case bytes.HasPrefix(data, ips_header):
+		return parse_ips(data)
+	}
+
+	return nil, errors.New("Unrecognized patch format")
+}
+
+// Build the error for data which does not start with the BPS magic, naming
+// its format if it is recognizably some other kind of patch
+func magic_error(data []byte) error {
+	for _, format := range foreign_formats {
+		if bytes.HasPrefix(data, format.magic) {
+			return fmt.Errorf("Magic Header Incorrect: not a BPS patch, file appears to be %s (starts with %q)", format.name, format.magic)
+		}
+	}
+	return errors.New("Magic Header Incorrect")
+}
@@ -0,0 +1,81 @@
+package bps
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOpenPatch(t *testing.T) {
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	cases := map[string][]byte{
+		"test/testpatch.bps": expectedtargetdata,
+		"test/testpatch.ups": expectedtargetdata,
+		"test/testpatch.ips": []byte("The Snow in spain falls mainly in the plains\n!!!!!"),
+	}
+
+	for path, expected := range cases {
+		data, _ := os.ReadFile(path)
+
+		patcher, err := OpenPatch(data)
+		if err != nil {
+			t.Fatalf("OpenPatch(%s) returned an error: %s", path, err)
+		}
+
+		targetdata, err := patcher.Apply(sourcedata)
+		if err != nil {
+			t.Fatalf("Applying %s returned an error: %s", path, err)
+		}
+
+		if !bytes.Equal(targetdata, expected) {
+			t.Fatalf("%s produced unexpected target data", path)
+		}
+	}
+}
+
+func TestOpenPatchUnknownFormat(t *testing.T) {
+	if _, err := OpenPatch([]byte("NOT A PATCH AT ALL")); err == nil {
+		t.Fatalf("OpenPatch accepted an unknown format")
+	}
+}
+
+func TestFromBytesForeignFormatHint(t *testing.T) {
+	ips, _ := os.ReadFile("test/testpatch.ips")
+	ups, _ := os.ReadFile("test/testpatch.ups")
+
+	cases := map[string][]byte{
+		"IPS":    ips,
+		"UPS":    ups,
+		"xdelta": {0xd6, 0xc3, 0xc4, 0x00},
+	}
+
+	for format, data := range cases {
+		_, err := FromBytes(data)
+		if err == nil || !strings.Contains(err.Error(), "appears to be "+format) {
+			t.Fatalf("FromBytes on a %s patch returned %v", format, err)
+		}
+	}
+
+	_, err := FromBytes([]byte("NOT A PATCH AT ALL"))
+	if err == nil || err.Error() != "Magic Header Incorrect" {
+		t.Fatalf("FromBytes on an unknown format returned %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	patchdata, _ := os.ReadFile("test/testpatch.bps")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	targetdata, err := Apply(patchdata, sourcedata)
+	if err != nil || !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("Apply did not produce the target: %v", err)
+	}
+
+	if _, err := Apply(sourcedata, sourcedata); err == nil {
+		t.Fatalf("Apply accepted a patch which is not BPS")
+	}
+}
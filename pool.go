@@ -0,0 +1,25 @@
+package bps
+
+import (
+	"sync"
+)
+
+// Buffers for reading source files into, which are only needed while a patch
+// is being applied.  Batch workflows apply many patches against sources of the
+// same size, so recycling these saves allocating a ROM sized buffer per apply.
+var source_buffers sync.Pool
+
+// Get a buffer of exactly size bytes, reusing a pooled buffer when one is
+// large enough.  The contents are not cleared.
+func get_source_buffer(size uint64) []byte {
+	if pooled, ok := source_buffers.Get().(*[]byte); ok && uint64(cap(*pooled)) >= size {
+		return (*pooled)[:size]
+	}
+	return make([]byte, size)
+}
+
+// Return a buffer from get_source_buffer to the pool.  The caller must not
+// use it afterwards.
+func put_source_buffer(buffer []byte) {
+	source_buffers.Put(&buffer)
+}
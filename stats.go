@@ -0,0 +1,106 @@
+package bps
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// A summary of what a patch's actions are made of
+type PatchStats struct {
+	// Total number of actions
+	Actions int
+	// Number of actions of each kind, indexed by SourceRead, TargetRead,
+	// SourceCopy and TargetCopy
+	Count [4]int
+	// Number of target bytes written by each kind of action, indexed the
+	// same way.  TargetRead bytes are the literal data stored in the patch.
+	Bytes [4]uint64
+}
+
+// Total number of target bytes written by all actions
+func (stats PatchStats) TotalBytes() uint64 {
+	return stats.Bytes[SourceRead] + stats.Bytes[TargetRead] + stats.Bytes[SourceCopy] + stats.Bytes[TargetCopy]
+}
+
+// Count the actions in the patch and how much of the target each kind of
+// action produces
+func (patch *BPSPatch) Stats() (stats PatchStats, err error) {
+	_, err = patch.walk_actions(func(action *resolved_action) error {
+		stats.Actions++
+		stats.Count[action.action_num]++
+		stats.Bytes[action.action_num] += action.length
+		return nil
+	})
+
+	return
+}
+
+// Measurements of a single run of ApplyWithMetrics, for exporting to a
+// monitoring system
+type ApplyMetrics struct {
+	// Number of actions applied
+	Actions int
+	// Target bytes read from the source, by SourceRead and SourceCopy
+	SourceBytes uint64
+	// Target bytes stored in the patch itself, by TargetRead
+	PatchBytes uint64
+	// Target bytes copied from earlier in the target, by TargetCopy
+	TargetCopyBytes uint64
+	// Time spent running the actions
+	ApplyDuration time.Duration
+	// Time spent verifying the source and target checksums
+	ChecksumDuration time.Duration
+}
+
+// Apply the patch to source data already held in memory, as PatchSourceBytes
+// does, measuring the run.  The counters are kept as each action is applied,
+// and the checksums verified separately from the actions to time them apart,
+// which costs nothing beyond the clock reads.  The metrics cover whatever was
+// done before any error.
+func (patch *BPSPatch) ApplyWithMetrics(source_data []byte) (target_data []byte, metrics ApplyMetrics, err error) {
+	opts := ApplyOptions{}
+	err = opts.check_sizes(patch)
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	err = patch.check_source_size(uint64(len(source_data)))
+	if err == nil {
+		calculated_source_checksum := ChecksumOf(source_data)
+		if calculated_source_checksum != patch.SourceChecksum {
+			err = &ChecksumError{Kind: ChecksumSource, Expected: patch.SourceChecksum, Actual: calculated_source_checksum}
+		}
+	}
+	metrics.ChecksumDuration = time.Since(start)
+	if err != nil {
+		return
+	}
+
+	start = time.Now()
+	target_data, err = patch.apply(context.Background(), bytes.NewReader(source_data), &slice_actions{data: patch.Actions}, nil, ApplyOptions{
+		SkipTargetChecksum: true,
+		OnAction: func(kind int, _, length uint64) {
+			metrics.Actions++
+			switch kind {
+			case SourceRead, SourceCopy:
+				metrics.SourceBytes += length
+			case TargetRead:
+				metrics.PatchBytes += length
+			case TargetCopy:
+				metrics.TargetCopyBytes += length
+			}
+		},
+	})
+	metrics.ApplyDuration = time.Since(start)
+	if err != nil {
+		return
+	}
+
+	start = time.Now()
+	err = opts.check_target_checksum(patch, ChecksumOf(target_data))
+	metrics.ChecksumDuration += time.Since(start)
+
+	return
+}
@@ -0,0 +1,81 @@
+package bps
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestStatsTrivialPatch(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	stats, err := patch.Stats()
+	if err != nil {
+		t.Fatalf("Stats returned an error: %s", err)
+	}
+
+	if stats.TotalBytes() != patch.TargetSize {
+		t.Fatalf("Stats cover %d bytes, expected %d", stats.TotalBytes(), patch.TargetSize)
+	}
+
+	count := stats.Count[SourceRead] + stats.Count[TargetRead] + stats.Count[SourceCopy] + stats.Count[TargetCopy]
+	if count != stats.Actions || stats.Actions == 0 {
+		t.Fatalf("Stats counted %d actions by kind but %d in total", count, stats.Actions)
+	}
+}
+
+func TestStatsCreatedPatch(t *testing.T) {
+	source := []byte("unchanged unchanged unchanged")
+	target := []byte("unchanged CHANGED!! unchanged")
+
+	patch, _ := CreatePatch(source, target, "")
+	stats, err := patch.Stats()
+	if err != nil {
+		t.Fatalf("Stats returned an error: %s", err)
+	}
+
+	if stats.Bytes[SourceRead] != 20 || stats.Bytes[TargetRead] != 9 || stats.Actions != 3 {
+		t.Fatalf("Unexpected stats for a linear patch: %+v", stats)
+	}
+}
+
+func TestApplyWithMetrics(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	targetdata, metrics, err := patch.ApplyWithMetrics(sourcedata)
+	if err != nil {
+		t.Fatalf("ApplyWithMetrics returned an error: %s", err)
+	}
+	if !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("ApplyWithMetrics produced the wrong target")
+	}
+
+	// The fixture embeds the whole target in a single TargetRead
+	if metrics.Actions != 1 || metrics.PatchBytes != patch.TargetSize || metrics.SourceBytes != 0 || metrics.TargetCopyBytes != 0 {
+		t.Fatalf("Unexpected metrics for the fixture: %+v", metrics)
+	}
+}
+
+func TestApplyWithMetricsMatchesStats(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+	stats, _ := patch.Stats()
+
+	_, metrics, err := patch.ApplyWithMetrics(source)
+	if err != nil {
+		t.Fatalf("ApplyWithMetrics returned an error: %s", err)
+	}
+	if metrics.Actions != stats.Actions || metrics.SourceBytes != stats.Bytes[SourceRead]+stats.Bytes[SourceCopy] ||
+		metrics.PatchBytes != stats.Bytes[TargetRead] || metrics.TargetCopyBytes != stats.Bytes[TargetCopy] {
+		t.Fatalf("Metrics %+v do not match stats %+v", metrics, stats)
+	}
+
+	_, metrics, err = patch.ApplyWithMetrics(source[1:])
+	if err == nil || metrics.Actions != 0 {
+		t.Fatalf("ApplyWithMetrics applied %d actions to the wrong source", metrics.Actions)
+	}
+}
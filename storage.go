@@ -0,0 +1,284 @@
+package bps
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// How much of the target ApplyToStorage holds in memory before writing it out
+const storage_window_size = 1 << 20
+
+// Somewhere to put a target too large to hold in memory, such as an *os.File.
+// The target is written through WriteAt, and read back through ReadAt for
+// TargetCopy actions reaching back past what is still held in memory.
+type TargetStorage interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Apply the patch to source, writing the target to dst as it is produced
+// rather than assembling it in memory.  Only a window of a megabyte of the
+// target is held in memory at once, and the source is read on demand as
+// ApplyReaderAt reads it, so memory use stays flat however large the files
+// are.  This makes it possible to patch multi-gigabyte disc images, at the
+// cost of a write for every megabyte and a read for every TargetCopy from
+// further back.
+//
+// The size limits, checksum, OnAction and OnCheckpoint settings of opts are
+// honored, and GrowTarget is ignored.  The default limits are set for targets
+// held in memory, so raise them to patch anything larger.  If the target
+// checksum fails, dst is left holding the target produced and a ChecksumError
+// is returned.
+func (patch *BPSPatch) ApplyToStorage(source io.ReaderAt, dst TargetStorage, opts ApplyOptions) (err error) {
+	defer func() { opts.log_apply(patch, err) }()
+
+	err = opts.check_sizes(patch)
+	if err != nil {
+		return err
+	}
+
+	if !opts.SkipSourceChecksum {
+		err = patch.verify_source_with(io.NewSectionReader(source, 0, int64(patch.SourceSize)), opts.new_hash())
+		if err != nil {
+			return err
+		}
+	}
+
+	target := &window_target{storage: dst, pending: make([]byte, 0, storage_window_size)}
+	if !opts.SkipTargetChecksum {
+		target.checksum = opts.new_hash()
+	}
+
+	return patch.apply_to_storage(source, target, &slice_actions{data: patch.Actions}, walk_state{}, opts)
+}
+
+// Run the actions left in actions from state onwards, writing to target, then
+// verify the target produced.  Used by both ApplyToStorage and ResumeApply.
+func (patch *BPSPatch) apply_to_storage(source io.ReaderAt, target *window_target, actions *slice_actions, state walk_state, opts ApplyOptions) error {
+	checkpointed := target.size()
+	scratch := make([]byte, storage_window_size)
+	err := patch.walk_actions_from(actions, &state, patch.TargetSize, func(action *resolved_action) error {
+		var err error
+		switch action.action_num {
+		case SourceRead, SourceCopy:
+			err = target.write_source(source, action.read_offset, action.length, scratch)
+		case TargetRead:
+			err = target.write(action.payload)
+		case TargetCopy:
+			err = target.copy(action.read_offset, action.length, scratch)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", action_names[action.action_num], err)
+		}
+
+		if opts.OnAction != nil {
+			opts.OnAction(int(action.action_num), action.output_offset, action.length)
+		}
+
+		// A checkpoint can only be taken between actions, once everything
+		// before it is in storage
+		if opts.OnCheckpoint != nil && target.size()-checkpointed >= storage_window_size {
+			err = target.flush()
+			if err != nil {
+				return fmt.Errorf("Target Write: %w", err)
+			}
+			checkpointed = target.size()
+
+			next := state
+			next.output_offset += action.length
+			err = opts.OnCheckpoint(patch.checkpoint(next, target, actions))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = target.flush()
+	if err != nil {
+		return fmt.Errorf("Target Write: %w", err)
+	}
+
+	// The walker checks every action fits in TargetSize, but not that they
+	// fill it
+	if target.size() != patch.TargetSize {
+		return fmt.Errorf("Patch produced %d bytes, expected %d", target.size(), patch.TargetSize)
+	}
+
+	if target.checksum != nil {
+		return opts.check_target_checksum(patch, target.checksum.Sum32())
+	}
+
+	return nil
+}
+
+// Apply the patch to source as ApplyToStorage does, with a new temporary file
+// in dir as the storage.  dir is passed to os.CreateTemp, so defaults to the
+// system temporary directory.  On success the file is returned positioned at
+// its start, for the caller to read and then close and remove; on failure it
+// is removed already.  An ErrTargetMismatchIgnored counts as success, and is
+// returned alongside the file.
+func (patch *BPSPatch) ApplyToTempFile(source io.ReaderAt, dir string, opts ApplyOptions) (*os.File, error) {
+	tempfile, err := os.CreateTemp(dir, "bps-target-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// An ignored target mismatch still delivers the target, alongside the
+	// error
+	apply_err := patch.ApplyToStorage(source, tempfile, opts)
+	err = apply_err
+	if err == nil || errors.Is(err, ErrTargetMismatchIgnored) {
+		_, err = tempfile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tempfile.Close()
+		os.Remove(tempfile.Name())
+		return nil, err
+	}
+
+	return tempfile, apply_err
+}
+
+// The target of ApplyToStorage: everything before flushed has been written to
+// storage, and pending holds what has been produced since
+type window_target struct {
+	storage  TargetStorage
+	flushed  uint64
+	pending  []byte
+	checksum hash.Hash32
+}
+
+// Number of target bytes produced so far
+func (target *window_target) size() uint64 {
+	return target.flushed + uint64(len(target.pending))
+}
+
+// Append data to the target, writing out the window once it fills
+func (target *window_target) write(data []byte) error {
+	for len(data) > 0 {
+		chunk := data
+		if room := storage_window_size - len(target.pending); len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		target.pending = append(target.pending, chunk...)
+		data = data[len(chunk):]
+
+		if len(target.pending) == storage_window_size {
+			err := target.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Write everything pending to storage and empty the window
+func (target *window_target) flush() error {
+	if len(target.pending) == 0 {
+		return nil
+	}
+
+	_, err := target.storage.WriteAt(target.pending, int64(target.flushed))
+	if err != nil {
+		return err
+	}
+	if target.checksum != nil {
+		target.checksum.Write(target.pending)
+	}
+
+	target.flushed += uint64(len(target.pending))
+	target.pending = target.pending[:0]
+	return nil
+}
+
+// Append length bytes of source starting at offset, through scratch
+func (target *window_target) write_source(source io.ReaderAt, offset, length uint64, scratch []byte) error {
+	for length > 0 {
+		chunk := scratch
+		if uint64(len(chunk)) > length {
+			chunk = chunk[:length]
+		}
+
+		err := read_source(source, chunk, offset)
+		if err != nil {
+			return err
+		}
+		err = target.write(chunk)
+		if err != nil {
+			return err
+		}
+
+		offset += uint64(len(chunk))
+		length -= uint64(len(chunk))
+	}
+
+	return nil
+}
+
+// Append length bytes copied from earlier in the target starting at
+// read_offset, reading back from storage whatever has already been flushed.
+// As with copy_target, the copy may overlap its own output.
+func (target *window_target) copy(read_offset, length uint64, scratch []byte) error {
+	// Only bytes which already exist can be copied, but every byte the copy
+	// writes repeats the one distance back, so any offset a multiple of
+	// distance back towards start holds the same bytes.  Reading each chunk
+	// from the earliest of them lets an overlapping copy, such as a distance
+	// one run, double its chunk every time as copy_target does.
+	start := read_offset
+	distance := target.size() - read_offset
+
+	for length > 0 {
+		base := start + (read_offset-start)%distance
+		// Prefer an offset still in the window over reading back storage
+		if base < target.flushed {
+			in_window := base + (target.flushed-base+distance-1)/distance*distance
+			if in_window < target.size() {
+				base = in_window
+			}
+		}
+
+		chunk := length
+		if available := target.size() - base; chunk > available {
+			chunk = available
+		}
+		if chunk > uint64(len(scratch)) {
+			chunk = uint64(len(scratch))
+		}
+
+		var data []byte
+		if base < target.flushed {
+			if chunk > target.flushed-base {
+				chunk = target.flushed - base
+			}
+			data = scratch[:chunk]
+			err := read_source(target.storage, data, base)
+			if err != nil {
+				return err
+			}
+		} else {
+			// Copied out first, as writing data may flush the window it
+			// points into
+			window_offset := base - target.flushed
+			data = scratch[:copy(scratch[:chunk], target.pending[window_offset:window_offset+chunk])]
+		}
+
+		err := target.write(data)
+		if err != nil {
+			return err
+		}
+
+		read_offset += chunk
+		length -= chunk
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+)
+
+// A TargetStorage held in memory, counting how often it is read back
+type memory_storage struct {
+	data  []byte
+	reads int
+}
+
+func (storage *memory_storage) WriteAt(p []byte, offset int64) (int, error) {
+	if end := int(offset) + len(p); end > len(storage.data) {
+		storage.data = append(storage.data, make([]byte, end-len(storage.data))...)
+	}
+	return copy(storage.data[offset:], p), nil
+}
+
+func (storage *memory_storage) ReadAt(p []byte, offset int64) (int, error) {
+	storage.reads++
+	if offset >= int64(len(storage.data)) {
+		return 0, io.EOF
+	}
+	read := copy(p, storage.data[offset:])
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func TestApplyToStorageFixture(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	var storage memory_storage
+	err := patch.ApplyToStorage(bytes.NewReader(sourcedata), &storage, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyToStorage returned an error: %s", err)
+	}
+	if !bytes.Equal(storage.data, expectedtargetdata) {
+		t.Fatalf("ApplyToStorage produced the wrong target")
+	}
+}
+
+func TestApplyToStoragePastWindow(t *testing.T) {
+	// A run filling several windows, then copies reaching back into what has
+	// been flushed, both clear of and overlapping the output
+	source := []byte("0123456789")
+	var encoded bytes.Buffer
+	write_action(&encoded, TargetRead, 4)
+	encoded.WriteString("abcd")
+	write_action(&encoded, TargetCopy, 3*storage_window_size)
+	write_relative_offset(&encoded, 3)
+	write_action(&encoded, TargetCopy, 4)
+	write_relative_offset(&encoded, -3*storage_window_size-3)
+	write_action(&encoded, TargetCopy, 100)
+	write_relative_offset(&encoded, 3*storage_window_size-2)
+	write_action(&encoded, SourceCopy, 10)
+	write_relative_offset(&encoded, 0)
+
+	target_size := uint64(4 + 3*storage_window_size + 4 + 100 + 10)
+	patch := craft_patch(source, target_size, encoded.Bytes())
+	expected, err := patch.ApplyWithOptions(source, ApplyOptions{SkipTargetChecksum: true})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions returned an error: %s", err)
+	}
+	patch.TargetChecksum = crc32.ChecksumIEEE(expected)
+
+	var storage memory_storage
+	err = patch.ApplyToStorage(bytes.NewReader(source), &storage, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyToStorage returned an error: %s", err)
+	}
+	if !bytes.Equal(storage.data, expected) {
+		t.Fatalf("ApplyToStorage produced a different target from ApplyWithOptions")
+	}
+	if storage.reads == 0 {
+		t.Fatalf("ApplyToStorage never read back from storage")
+	}
+}
+
+func TestApplyToStorageChecksums(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+
+	var checksum_err *ChecksumError
+	err := patch.ApplyToStorage(bytes.NewReader(target), &memory_storage{}, ApplyOptions{})
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumSource {
+		t.Fatalf("ApplyToStorage to the wrong source returned %v", err)
+	}
+
+	bad_target := patch.Clone()
+	bad_target.TargetChecksum ^= 1
+	err = bad_target.ApplyToStorage(bytes.NewReader(source), &memory_storage{}, ApplyOptions{})
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumTarget {
+		t.Fatalf("ApplyToStorage with the wrong target checksum returned %v", err)
+	}
+}
+
+func TestApplyToTempFile(t *testing.T) {
+	source, target := synthetic_rom(1 << 12)
+	patch, _ := CreatePatchDelta(source, target, EncodeOptions{})
+	dir := t.TempDir()
+
+	tempfile, err := patch.ApplyToTempFile(bytes.NewReader(source), dir, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyToTempFile returned an error: %s", err)
+	}
+	defer tempfile.Close()
+
+	targetdata, _ := io.ReadAll(tempfile)
+	if !bytes.Equal(targetdata, target) {
+		t.Fatalf("ApplyToTempFile produced the wrong target")
+	}
+
+	// A failed apply leaves nothing behind
+	_, err = patch.ApplyToTempFile(bytes.NewReader(target), dir, ApplyOptions{})
+	entries, _ := os.ReadDir(dir)
+	if err == nil || len(entries) != 1 {
+		t.Fatalf("Failed ApplyToTempFile left %d files, error %v", len(entries), err)
+	}
+}
+
+func TestApplyToStorageOverlappingCopies(t *testing.T) {
+	// Runs repeating one and three bytes, each over several windows
+	var encoded bytes.Buffer
+	write_action(&encoded, TargetRead, 1)
+	encoded.WriteString("x")
+	write_action(&encoded, TargetCopy, 3*storage_window_size)
+	write_relative_offset(&encoded, 0)
+	write_action(&encoded, TargetRead, 3)
+	encoded.WriteString("abc")
+	write_action(&encoded, TargetCopy, 3*storage_window_size+5)
+	write_relative_offset(&encoded, 2)
+
+	target_size := uint64(1 + 3*storage_window_size + 3 + 3*storage_window_size + 5)
+	patch := craft_patch(nil, target_size, encoded.Bytes())
+	expected, err := patch.ApplyWithOptions(nil, ApplyOptions{SkipTargetChecksum: true})
+	if err != nil {
+		t.Fatalf("ApplyWithOptions returned an error: %s", err)
+	}
+	patch.TargetChecksum = crc32.ChecksumIEEE(expected)
+
+	var storage memory_storage
+	err = patch.ApplyToStorage(bytes.NewReader(nil), &storage, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyToStorage returned an error: %s", err)
+	}
+	if !bytes.Equal(storage.data, expected) {
+		t.Fatalf("ApplyToStorage produced a different target from ApplyWithOptions")
+	}
+
+	// The runs are copied in growing chunks from the window, reading back
+	// from storage at most once for each window flushed
+	if storage.reads > 7 {
+		t.Fatalf("ApplyToStorage read back from storage %d times", storage.reads)
+	}
+}
+
+func BenchmarkApplyToStorageRLE(b *testing.B) {
+	const size = 16 << 20
+	patch := bench_patch(b, size, []Action{
+		{Kind: TargetRead, Length: 1, Data: []byte{0xff}},
+		{Kind: TargetCopy, Length: size - 1},
+	})
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var storage memory_storage
+		patch.ApplyToStorage(bytes.NewReader(nil), &storage, ApplyOptions{})
+	}
+}
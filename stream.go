@@ -0,0 +1,178 @@
+package bps
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Read exactly one BPS patch from the start of r, leaving r positioned just
+// past its footer, and return the number of bytes the patch took up.  Unlike
+// FromReader, this does not assume the patch runs to EOF, so trailing data or
+// further patches can follow it.
+//
+// A patch records no length of its own, so the end is found by reading
+// actions until they cover TargetSize, which means reading r a byte at a time.
+// Wrap r in a bufio.Reader for speed, and keep reading from that.
+//
+// Returns io.EOF, unwrapped, if r is already at EOF, and the patch is verified
+// as FromBytes does otherwise.
+func ReadPatch(r io.Reader) (patch BPSPatch, consumed int64, err error) {
+	stream := recording_reader{r: r}
+	stream.byte_reader, _ = r.(io.ByteReader)
+
+	magic := make([]byte, len(Magic))
+	_, err = io.ReadFull(&stream, magic)
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("Error reading magic header: %w", err)
+		return
+	}
+	if string(magic) != Magic {
+		err = magic_error(magic)
+		return
+	}
+
+	var sizes [3]uint64
+	for i, name := range []string{"source", "target", "metadata"} {
+		sizes[i], err = stream.read_num()
+		if err != nil {
+			err = fmt.Errorf("Error reading %s size: %w", name, err)
+			return
+		}
+	}
+	target_size, metadata_size := sizes[1], sizes[2]
+
+	// Sizes come from the patch, so copy rather than allocate for them, and
+	// let a truncated stream fail the copy
+	err = stream.skip(metadata_size)
+	if err != nil {
+		err = fmt.Errorf("Error reading metadata: %w", err)
+		return
+	}
+
+	var output_offset uint64
+	for output_offset < target_size {
+		var header uint64
+		header, err = stream.read_num()
+		if err != nil {
+			err = fmt.Errorf("Read Action: %w", err)
+			return
+		}
+		action_num, length := header&0b11, (header>>2)+1
+
+		err = check_bounds(action_names[action_num], "target", output_offset, length, target_size)
+		if err != nil {
+			return
+		}
+
+		switch action_num {
+		case TargetRead:
+			err = stream.skip(length)
+		case SourceCopy, TargetCopy:
+			_, err = stream.read_num()
+		}
+		if err != nil {
+			err = fmt.Errorf("%s at output %d: %w", action_names[action_num], output_offset, err)
+			return
+		}
+
+		output_offset += length
+	}
+
+	err = stream.skip(FooterSize)
+	if err != nil {
+		err = fmt.Errorf("Error reading checksum footer: %w", err)
+		return
+	}
+
+	consumed = int64(stream.recorded.Len())
+	patch, err = FromBytes(stream.recorded.Bytes())
+	return
+}
+
+// Read every BPS patch from a stream holding several back to back, such as a
+// base patch followed by variants of it.  Each patch is verified on its own,
+// and the stream must end exactly where the last patch does.
+func FromReaderAll(r io.Reader) ([]BPSPatch, error) {
+	if _, ok := r.(io.ByteReader); !ok {
+		r = bufio.NewReader(r)
+	}
+
+	var patches []BPSPatch
+	for {
+		patch, _, err := ReadPatch(r)
+		if err == io.EOF {
+			return patches, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Patch %d: %w", len(patches)+1, err)
+		}
+		patches = append(patches, patch)
+	}
+}
+
+// Keeps a copy of every byte read through it, reading no further ahead in r
+// than it is asked to
+type recording_reader struct {
+	r           io.Reader
+	byte_reader io.ByteReader
+	recorded    bytes.Buffer
+}
+
+func (stream *recording_reader) Read(p []byte) (int, error) {
+	read, err := stream.r.Read(p)
+	stream.recorded.Write(p[:read])
+	return read, err
+}
+
+func (stream *recording_reader) ReadByte() (byte, error) {
+	if stream.byte_reader == nil {
+		var b [1]byte
+		_, err := io.ReadFull(stream, b[:])
+		return b[0], err
+	}
+
+	b, err := stream.byte_reader.ReadByte()
+	if err == nil {
+		stream.recorded.WriteByte(b)
+	}
+	return b, err
+}
+
+// Read a variable length number a byte at a time, stopping at its final byte
+// or once it is too long for bps_read_num to accept
+func (stream *recording_reader) read_num() (uint64, error) {
+	start := stream.recorded.Len()
+	for stream.recorded.Len()-start < max_varint_len {
+		b, err := stream.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b&0x80 == 0x80 {
+			break
+		}
+	}
+
+	data, _, err := bps_read_num(stream.recorded.Bytes()[start:])
+	return data, err
+}
+
+// Read past length bytes, which are still recorded
+func (stream *recording_reader) skip(length uint64) error {
+	if length > math.MaxInt64 {
+		return fmt.Errorf("Length %d too large to read", length)
+	}
+	_, err := io.CopyN(io.Discard, stream, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package bps
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadPatchTrailingData(t *testing.T) {
+	for _, path := range []string{"test/testpatch.bps", "test/7f2e1606616492d7dfb589e8dfb70027.bps"} {
+		data, _ := os.ReadFile(path)
+		expected, _ := FromBytes(data)
+
+		// A MultiReader is not an io.ByteReader, so this also covers reading
+		// one byte at a time
+		readers := map[string]io.Reader{
+			"plain":    io.MultiReader(bytes.NewReader(data), bytes.NewReader([]byte("trailing"))),
+			"buffered": bufio.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader([]byte("trailing")))),
+		}
+
+		for name, r := range readers {
+			patch, consumed, err := ReadPatch(r)
+			if err != nil {
+				t.Fatalf("ReadPatch of %s from a %s reader returned an error: %s", path, name, err)
+			}
+			if consumed != int64(len(data)) || !patch.Equal(&expected) {
+				t.Fatalf("ReadPatch of %s from a %s reader consumed %d of %d bytes", path, name, consumed, len(data))
+			}
+
+			trailing, _ := io.ReadAll(r)
+			if string(trailing) != "trailing" {
+				t.Fatalf("ReadPatch of %s from a %s reader left %q behind", path, name, trailing)
+			}
+		}
+	}
+}
+
+func TestReadPatchErrors(t *testing.T) {
+	if _, _, err := ReadPatch(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("ReadPatch of an empty stream returned %v", err)
+	}
+
+	data, _ := os.ReadFile("test/testpatch.bps")
+	for _, length := range []int{2, 6, 20, len(data) - 1} {
+		if _, _, err := ReadPatch(bytes.NewReader(data[:length])); err == nil || err == io.EOF {
+			t.Fatalf("ReadPatch of a patch truncated to %d bytes returned %v", length, err)
+		}
+	}
+
+	ips, _ := os.ReadFile("test/testpatch.ips")
+	if _, _, err := ReadPatch(bytes.NewReader(ips)); err == nil {
+		t.Fatalf("ReadPatch accepted an IPS patch")
+	}
+
+	// A metadata size too large to represent must not be mistaken for zero
+	hostile := append([]byte("BPS1\x80\x80"), 0x7f, 0x7e, 0x7e, 0x7e, 0x7e, 0x7e, 0x7e, 0x7e, 0x7e, 0x80)
+	if _, _, err := ReadPatch(bytes.NewReader(hostile)); err == nil {
+		t.Fatalf("ReadPatch accepted a huge metadata size")
+	}
+}
+
+func TestFromReaderAll(t *testing.T) {
+	first_data, _ := os.ReadFile("test/testpatch.bps")
+	second_data, _ := os.ReadFile("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	first, _ := FromBytes(first_data)
+	second, _ := FromBytes(second_data)
+
+	concatenated := io.MultiReader(bytes.NewReader(first_data), bytes.NewReader(second_data), bytes.NewReader(first_data))
+	patches, err := FromReaderAll(concatenated)
+	if err != nil {
+		t.Fatalf("FromReaderAll returned an error: %s", err)
+	}
+
+	if len(patches) != 3 || !patches[0].Equal(&first) || !patches[1].Equal(&second) || !patches[2].Equal(&first) {
+		t.Fatalf("FromReaderAll parsed %d patches incorrectly", len(patches))
+	}
+
+	patches, err = FromReaderAll(bytes.NewReader(nil))
+	if err != nil || len(patches) != 0 {
+		t.Fatalf("FromReaderAll of an empty stream returned %d patches, %v", len(patches), err)
+	}
+
+	trailing := io.MultiReader(bytes.NewReader(first_data), bytes.NewReader([]byte("junk")))
+	if _, err := FromReaderAll(trailing); err == nil || !strings.HasPrefix(err.Error(), "Patch 2") {
+		t.Fatalf("FromReaderAll accepted trailing junk: %v", err)
+	}
+}
+
+func TestReadPatchVarintTooLong(t *testing.T) {
+	endless := io.MultiReader(bytes.NewReader([]byte("BPS1")), bytes.NewReader(make([]byte, 1<<20)))
+	_, _, err := ReadPatch(endless)
+	if err == nil || !strings.Contains(err.Error(), "varint too long") {
+		t.Fatalf("ReadPatch of an endless varint returned %v", err)
+	}
+}
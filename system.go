@@ -0,0 +1,33 @@
+package bps
+
+// Systems guessed from a source size by GuessSystem.  Only sizes which are
+// common for one system and rare for the others are listed.  Most cartridge
+// sizes are powers of two shared between systems: 1MB and 2MB are as likely
+// Game Boy ROMs as Super Nintendo ones, and 4MB and 8MB could be Game Boy
+// Advance or Mega Drive, so those are left out.  A Super Nintendo ROM carrying
+// the 512 byte header copier devices add is distinctive at any size.
+var system_sizes = map[uint64]string{
+	// Game Boy cartridges without a bank controller
+	32 << 10: "GB",
+
+	1<<20 + 512: "SNES 1MB (copier header)",
+	2<<20 + 512: "SNES 2MB (copier header)",
+	3<<20 + 512: "SNES 3MB (copier header)",
+	4<<20 + 512: "SNES 4MB (copier header)",
+	6 << 20:     "SNES 6MB",
+	6<<20 + 512: "SNES 6MB (copier header)",
+
+	16 << 20: "GBA",
+	32 << 20: "GBA",
+}
+
+// Guess which system the patch is for from its SourceSize, for display by
+// tools built on the library.  The format stores nothing about the system, so
+// this is only a best effort from the sizes ROMs commonly have, and returns
+// "unknown" for any size that is not a clear match.
+func (patch *BPSPatch) GuessSystem() string {
+	if system, ok := system_sizes[patch.SourceSize]; ok {
+		return system
+	}
+	return "unknown"
+}
@@ -0,0 +1,34 @@
+package bps
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGuessSystem(t *testing.T) {
+	// The ALttP randomizer patch applies to the 1MB headerless US ROM, a size
+	// Game Boy ROMs share
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	patch, _ := FromFile(patchfile)
+	if system := patch.GuessSystem(); system != "unknown" {
+		t.Fatalf("ALttP patch guessed as %q, expected %q", system, "unknown")
+	}
+
+	cases := map[uint64]string{
+		0:           "unknown",
+		45:          "unknown",
+		32 << 10:    "GB",
+		512 << 10:   "unknown",
+		4<<20 + 512: "SNES 4MB (copier header)",
+		16 << 20:    "GBA",
+		2 << 20:     "unknown",
+		8 << 20:     "unknown",
+		1<<20 + 1:   "unknown",
+	}
+	for size, expected := range cases {
+		patch := BPSPatch{SourceSize: size}
+		if system := patch.GuessSystem(); system != expected {
+			t.Fatalf("Source size %d guessed as %q, expected %q", size, system, expected)
+		}
+	}
+}
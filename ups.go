@@ -0,0 +1,138 @@
+package bps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var (
+	ups_header = []byte("UPS1")
+)
+
+// A UPS patch.  UPS stores the target as a series of hunks, each a relative
+// offset followed by bytes to XOR against the source, using the same variable
+// length numbers as BPS.
+type UPSPatch struct {
+	InputSize      uint64
+	OutputSize     uint64
+	Hunks          []byte
+	InputChecksum  uint32
+	OutputChecksum uint32
+	PatchChecksum  uint32
+}
+
+// Read a UPS patch, verifying the patch checksum
+func FromUPS(data []byte) (*UPSPatch, error) {
+	if len(data) < len(ups_header)+2+12 {
+		return nil, fmt.Errorf("UPS patch too short: %d bytes", len(data))
+	}
+
+	if !bytes.Equal(data[:len(ups_header)], ups_header) {
+		return nil, errors.New("UPS Magic Header Incorrect")
+	}
+
+	input_size, remaining, err := bps_read_num(data[len(ups_header):])
+	if err != nil {
+		return nil, fmt.Errorf("Error reading input size: %w", err)
+	}
+
+	output_size, remaining, err := bps_read_num(remaining)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading output size: %w", err)
+	}
+
+	if len(remaining) < 12 {
+		return nil, errors.New("UPS patch truncated before the checksums")
+	}
+	hunks, footer := remaining[:len(remaining)-12], remaining[len(remaining)-12:]
+
+	patch := &UPSPatch{
+		InputSize:      input_size,
+		OutputSize:     output_size,
+		Hunks:          hunks,
+		InputChecksum:  binary.LittleEndian.Uint32(footer[:4]),
+		OutputChecksum: binary.LittleEndian.Uint32(footer[4:8]),
+		PatchChecksum:  binary.LittleEndian.Uint32(footer[8:12]),
+	}
+
+	calculated_patch_checksum := crc32.ChecksumIEEE(data[:len(data)-4])
+	if calculated_patch_checksum != patch.PatchChecksum {
+		return nil, &ChecksumError{Kind: ChecksumPatch, Expected: patch.PatchChecksum, Actual: calculated_patch_checksum}
+	}
+
+	return patch, nil
+}
+
+// Apply the UPS patch to source.  UPS patches are reversible, so if source
+// matches the patch's output instead of its input the patch is applied
+// backwards to recover the input.  The checksums of the source and the
+// returned bytes are verified.
+func (patch *UPSPatch) Apply(source []byte) ([]byte, error) {
+	source_checksum := crc32.ChecksumIEEE(source)
+
+	target_size, target_checksum := patch.OutputSize, patch.OutputChecksum
+	switch {
+	case uint64(len(source)) == patch.InputSize && source_checksum == patch.InputChecksum:
+	case uint64(len(source)) == patch.OutputSize && source_checksum == patch.OutputChecksum:
+		target_size, target_checksum = patch.InputSize, patch.InputChecksum
+	default:
+		return nil, &ChecksumError{Kind: ChecksumSource, Expected: patch.InputChecksum, Actual: source_checksum}
+	}
+
+	err := ApplyOptions{}.check_sizes(&BPSPatch{SourceSize: uint64(len(source)), TargetSize: target_size})
+	if err != nil {
+		return nil, err
+	}
+
+	target := make([]byte, target_size)
+	copy(target, source)
+
+	// Hunks cover the larger of the two files.  When applying backwards to a
+	// smaller file, changes past its end are dropped.
+	hunk_size := patch.InputSize
+	if patch.OutputSize > hunk_size {
+		hunk_size = patch.OutputSize
+	}
+
+	remaining := patch.Hunks
+	var offset uint64
+	for len(remaining) > 0 {
+		var skip uint64
+		skip, remaining, err = bps_read_num(remaining)
+		if err != nil {
+			return nil, fmt.Errorf("Read Hunk: %w", err)
+		}
+		if offset > hunk_size || skip > hunk_size-offset {
+			return nil, fmt.Errorf("UPS hunk out of bounds: offset %d skip %d size %d", offset, skip, hunk_size)
+		}
+		offset += skip
+
+		// XOR bytes run until a zero byte, which also accounts for one
+		// unchanged byte
+		for {
+			if len(remaining) == 0 {
+				return nil, errors.New("UPS hunk ended without a terminator")
+			}
+			x := remaining[0]
+			remaining = remaining[1:]
+			if x == 0 {
+				offset++
+				break
+			}
+			if offset < target_size {
+				target[offset] ^= x
+			}
+			offset++
+		}
+	}
+
+	calculated_target_checksum := crc32.ChecksumIEEE(target)
+	if calculated_target_checksum != target_checksum {
+		return target, &ChecksumError{Kind: ChecksumTarget, Expected: target_checksum, Actual: calculated_target_checksum}
+	}
+
+	return target, nil
+}
@@ -0,0 +1,68 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestUPSApply(t *testing.T) {
+	upsdata, _ := os.ReadFile("test/testpatch.ups")
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	expectedtargetdata, _ := os.ReadFile("test/targetFile")
+
+	patch, err := FromUPS(upsdata)
+	if err != nil {
+		t.Fatalf("FromUPS returned an error: %s", err)
+	}
+
+	if patch.InputSize != 45 || patch.OutputSize != 92 || patch.InputChecksum != 0x133070d || patch.OutputChecksum != 0x76c91265 {
+		t.Fatalf("FromUPS parsed unexpected header: %+v", patch)
+	}
+
+	targetdata, err := patch.Apply(sourcedata)
+	if err != nil {
+		t.Fatalf("Apply returned an error: %s", err)
+	}
+
+	if !bytes.Equal(targetdata, expectedtargetdata) {
+		t.Fatalf("Expected target data does not match target data")
+	}
+
+	// UPS patches also apply backwards
+	reversed, err := patch.Apply(expectedtargetdata)
+	if err != nil {
+		t.Fatalf("Reverse Apply returned an error: %s", err)
+	}
+
+	if !bytes.Equal(reversed, sourcedata) {
+		t.Fatalf("Reverse application did not restore the source")
+	}
+}
+
+func TestUPSWrongSource(t *testing.T) {
+	upsdata, _ := os.ReadFile("test/testpatch.ups")
+	patch, _ := FromUPS(upsdata)
+
+	var checksum_err *ChecksumError
+	_, err := patch.Apply(make([]byte, 45))
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumSource {
+		t.Fatalf("Apply did not return a source ChecksumError: %v", err)
+	}
+}
+
+func TestFromUPSCorrupt(t *testing.T) {
+	upsdata, _ := os.ReadFile("test/testpatch.ups")
+	upsdata[8] ^= 0xff
+
+	var checksum_err *ChecksumError
+	_, err := FromUPS(upsdata)
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumPatch {
+		t.Fatalf("FromUPS did not return a patch ChecksumError: %v", err)
+	}
+
+	if _, err := FromUPS([]byte("UPS1")); err == nil {
+		t.Fatalf("FromUPS accepted a truncated patch")
+	}
+}
@@ -0,0 +1,143 @@
+package bps
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// How much of a stream crc_reader holds in memory at once
+const crc_chunk_size = 64 << 10
+
+// Calculate the checksum BPS uses, CRC32 with the IEEE polynomial, for
+// comparing files against SourceChecksum and TargetChecksum
+func ChecksumOf(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// What a patch needs of its source file, for finding a matching file before
+// trying to apply the patch
+type SourceReq struct {
+	// Size of the source file in bytes
+	Size uint64
+	// CRC32 of the source file
+	Checksum uint32
+}
+
+// Report the size and checksum the source file must have for this patch to
+// apply.  VerifySource checks a candidate file against these.
+func (patch *BPSPatch) SourceRequirements() SourceReq {
+	return SourceReq{Size: patch.SourceSize, Checksum: patch.SourceChecksum}
+}
+
+// Check that src is the source file this patch was created for, without
+// applying the patch.  src is streamed through the checksum rather than read
+// into memory, so this is cheap even for large files.  Returns a
+// ChecksumError if the checksum does not match.
+func (patch *BPSPatch) VerifySource(src io.Reader) error {
+	source_checksum, source_read, err := crc_reader(src)
+	if err != nil {
+		return fmt.Errorf("Source Read: %w", err)
+	}
+
+	return patch.check_source(source_checksum, source_read)
+}
+
+// Check src as VerifySource does, calculating the checksum with checksum
+func (patch *BPSPatch) verify_source_with(src io.Reader, checksum hash.Hash32) error {
+	source_read, err := io.CopyBuffer(checksum, src, make([]byte, crc_chunk_size))
+	if err != nil {
+		return fmt.Errorf("Source Read: %w", err)
+	}
+
+	return patch.check_source(checksum.Sum32(), source_read)
+}
+
+// Compare the size and checksum of a candidate source against the patch
+func (patch *BPSPatch) check_source(source_checksum uint32, source_read int64) error {
+	err := patch.check_source_size(uint64(source_read))
+	if err != nil {
+		return err
+	}
+
+	if source_checksum != patch.SourceChecksum {
+		return &ChecksumError{Kind: ChecksumSource, Expected: patch.SourceChecksum, Actual: source_checksum}
+	}
+
+	return nil
+}
+
+// Compare the size of a candidate source against the patch.  A source of the
+// wrong size can only fail the checksum, so this is checked first to say why:
+// a larger source is usually a ROM for another region or with a copier
+// header, and a smaller one a truncated dump.
+func (patch *BPSPatch) check_source_size(size uint64) error {
+	if size != patch.SourceSize {
+		return &SourceSizeError{Expected: patch.SourceSize, Actual: size, checksum: patch.SourceChecksum}
+	}
+	return nil
+}
+
+// Compare the size of an open source file against the patch, as
+// check_source_size does.  Only regular files have a size to compare.
+func (patch *BPSPatch) check_source_file_size(sourcefile *os.File) error {
+	info, err := sourcefile.Stat()
+	if err != nil {
+		return fmt.Errorf("Error performing stat on source file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return patch.check_source_size(uint64(info.Size()))
+}
+
+// Check the patch file in data is not corrupt, by comparing the trailing patch
+// checksum against the rest of the file, without parsing anything else.
+// Returns a ChecksumError if the checksum does not match.
+func VerifyPatchChecksum(data []byte) error {
+	return verify_patch_checksum(data, crc32.NewIEEE())
+}
+
+// Check the patch checksum as VerifyPatchChecksum does, calculated with
+// checksum
+func verify_patch_checksum(data []byte, checksum hash.Hash32) error {
+	if len(data) < 4 {
+		return fmt.Errorf("Patch too short: %d bytes, the patch checksum alone needs 4", len(data))
+	}
+
+	stored_checksum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	checksum.Write(data[:len(data)-4])
+	calculated_checksum := checksum.Sum32()
+	if calculated_checksum != stored_checksum {
+		return &ChecksumError{Kind: ChecksumPatch, Expected: stored_checksum, Actual: calculated_checksum}
+	}
+
+	return nil
+}
+
+// Calculate the CRC32 of everything read from r, a chunk at a time so that
+// only crc_chunk_size bytes are ever held in memory.  Returns the checksum and
+// the number of bytes read.
+func crc_reader(r io.Reader) (checksum uint32, size int64, err error) {
+	out := &crc_writer{w: io.Discard}
+	size, err = io.CopyBuffer(out, r, make([]byte, crc_chunk_size))
+	if err != nil {
+		return 0, size, err
+	}
+	return out.crc, size, nil
+}
+
+// Passes writes through to w, keeping the CRC32 of everything written
+type crc_writer struct {
+	w   io.Writer
+	crc uint32
+}
+
+func (out *crc_writer) Write(p []byte) (int, error) {
+	written, err := out.w.Write(p)
+	out.crc = crc32.Update(out.crc, crc32.IEEETable, p[:written])
+	return written, err
+}
@@ -0,0 +1,132 @@
+package bps
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifySource(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	sourcefile, _ := os.Open("test/sourceFile")
+	defer sourcefile.Close()
+	if err := patch.VerifySource(sourcefile); err != nil {
+		t.Fatalf("VerifySource rejected the correct source: %s", err)
+	}
+
+	targetdata, _ := os.ReadFile("test/targetFile")
+
+	var checksum_err *ChecksumError
+	err := patch.VerifySource(bytes.NewReader(targetdata[:patch.SourceSize]))
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumSource {
+		t.Fatalf("VerifySource did not return a source ChecksumError: %v", err)
+	}
+
+	var size_err *SourceSizeError
+	err = patch.VerifySource(bytes.NewReader(targetdata))
+	if !errors.As(err, &size_err) {
+		t.Fatalf("VerifySource did not return a SourceSizeError: %v", err)
+	}
+}
+
+func TestVerifySourceShort(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+
+	if err := patch.VerifySource(strings.NewReader("The Rain")); err == nil {
+		t.Fatalf("VerifySource accepted a truncated source")
+	}
+}
+
+func TestVerifyPatchChecksum(t *testing.T) {
+	data, _ := os.ReadFile("test/testpatch.bps")
+	if err := VerifyPatchChecksum(data); err != nil {
+		t.Fatalf("VerifyPatchChecksum rejected testpatch.bps: %s", err)
+	}
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[10] ^= 0x01
+
+	var checksum_err *ChecksumError
+	err := VerifyPatchChecksum(corrupted)
+	if !errors.As(err, &checksum_err) || checksum_err.Kind != ChecksumPatch || checksum_err.Expected != 0xc18e4db1 {
+		t.Fatalf("VerifyPatchChecksum did not return a patch ChecksumError: %v", err)
+	}
+
+	if err := VerifyPatchChecksum([]byte("BPS")); err == nil {
+		t.Fatalf("VerifyPatchChecksum accepted a 3 byte patch")
+	}
+}
+
+func TestSourceRequirements(t *testing.T) {
+	patchfile, _ := os.Open("test/7f2e1606616492d7dfb589e8dfb70027.bps")
+	patch, _ := FromFile(patchfile)
+
+	requirements := patch.SourceRequirements()
+	if requirements.Size != 1<<20 || requirements.Checksum != 0x3322effc {
+		t.Fatalf("SourceRequirements incorrect: %+v", requirements)
+	}
+}
+
+func TestCRCReader(t *testing.T) {
+	data := make([]byte, 3*crc_chunk_size+17)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	checksum, size, err := crc_reader(bytes.NewReader(data))
+	if err != nil || checksum != crc32.ChecksumIEEE(data) || size != int64(len(data)) {
+		t.Fatalf("crc_reader calculated %08x over %d bytes: %v", checksum, size, err)
+	}
+}
+
+func BenchmarkVerifySource(b *testing.B) {
+	source, target := synthetic_rom(4 << 20)
+	patch, _ := CreatePatch(source, target, "")
+
+	b.Run("chunked", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(source)))
+		for i := 0; i < b.N; i++ {
+			patch.VerifySource(bytes.NewReader(source))
+		}
+	})
+
+	// For comparison, reading the whole source into memory first
+	b.Run("full-read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(source)))
+		for i := 0; i < b.N; i++ {
+			data, _ := io.ReadAll(bytes.NewReader(source))
+			crc32.ChecksumIEEE(data)
+		}
+	})
+}
+
+func TestCRCWriter(t *testing.T) {
+	data := []byte("running checksum")
+	var buf bytes.Buffer
+	out := &crc_writer{w: &buf}
+	out.Write(data[:7])
+	out.Write(data[7:])
+
+	if out.crc != crc32.ChecksumIEEE(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("crc_writer calculated %08x and wrote %q", out.crc, buf.Bytes())
+	}
+}
+
+func TestChecksumOf(t *testing.T) {
+	patchfile, _ := os.Open("test/testpatch.bps")
+	patch, _ := FromFile(patchfile)
+	sourcedata, _ := os.ReadFile("test/sourceFile")
+	targetdata, _ := os.ReadFile("test/targetFile")
+
+	if ChecksumOf(sourcedata) != patch.SourceChecksum || ChecksumOf(targetdata) != patch.TargetChecksum {
+		t.Fatalf("ChecksumOf does not match the fixture's checksums")
+	}
+}